@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type adminHandler struct {
+	pb.UnimplementedTransactionAdminServiceServer
+
+	inspector transaction.TransactionInspector
+	resolver  transaction.TransactionResolver
+}
+
+func NewAdminHandler(
+	server *grpc.Server,
+	inspector transaction.TransactionInspector,
+	resolver transaction.TransactionResolver) {
+
+	handler := &adminHandler{
+		inspector: inspector,
+		resolver:  resolver,
+	}
+	pb.RegisterTransactionAdminServiceServer(server, handler)
+}
+
+func (h *adminHandler) GetTransaction(ctx context.Context, req *pb.GetTransactionRequest) (*pb.Transaction, error) {
+	state, err := h.inspector.GetTransaction(req.Id)
+	if err != nil {
+		return nil, transactionError(err)
+	}
+
+	return toTransaction(state), nil
+}
+
+func (h *adminHandler) ListTransactions(ctx context.Context, req *pb.ListTransactionsRequest) (*pb.ListTransactionsResponse, error) {
+	query := transaction.TransactionQuery{
+		Type:   transaction.TransactionType(req.Type),
+		Status: transaction.TransactionStatus(req.Status),
+	}
+	if req.MinAge != nil {
+		query.Until = time.Now().Add(-req.MinAge.AsDuration())
+	}
+	if req.MaxAge != nil {
+		query.Since = time.Now().Add(-req.MaxAge.AsDuration())
+	}
+
+	after, err := decodePageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token: %v", err)
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	pageSize = min(pageSize, maxPageSize)
+
+	states, err := h.inspector.ListTransactions(query)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error in list transactions: %v", err)
+	}
+
+	// the states are ordered by type and id, so the page starts after the token
+	resp := &pb.ListTransactionsResponse{}
+	var last string
+	for _, state := range states {
+		key := string(state.Type) + "/" + state.Id
+		if after != "" && comparePage(key, after) <= 0 {
+			continue
+		}
+
+		if len(resp.Transactions) == pageSize {
+			resp.NextPageToken = encodePageToken(last)
+			break
+		}
+		resp.Transactions = append(resp.Transactions, toTransaction(state))
+		last = key
+	}
+
+	return resp, nil
+}
+
+func (h *adminHandler) WatchTransaction(req *pb.WatchTransactionRequest, stream grpc.ServerStreamingServer[pb.Transaction]) error {
+	log.Printf("admin: watch transaction %s\n", req.Id)
+
+	states, err := h.inspector.WatchTransaction(req.Id, stream.Context().Done())
+	if err != nil {
+		return transactionError(err)
+	}
+
+	for state := range states {
+		if err := stream.Send(toTransaction(state)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *adminHandler) ResolveTransaction(ctx context.Context, req *pb.ResolveTransactionRequest) (*pb.Transaction, error) {
+	log.Printf("admin: %s resolves transaction %s to %s\n", req.Operator, req.Id, req.Decision)
+
+	resolution := transaction.Resolution{
+		Decision:  transaction.TransactionStatus(req.Decision),
+		Reason:    req.Reason,
+		Operator:  req.Operator,
+		Heuristic: req.Heuristic,
+	}
+	if resolution.Operator == "" || resolution.Reason == "" {
+		return nil, status.Error(codes.InvalidArgument, "operator and reason are required")
+	}
+	if resolution.Decision != transaction.StatusCommit && resolution.Decision != transaction.StatusRollBack {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid decision %s", req.Decision)
+	}
+
+	state, err := h.resolver.ResolveTransaction(req.Id, resolution)
+	if err != nil {
+		return nil, transactionError(err)
+	}
+
+	return toTransaction(state), nil
+}
+
+func toTransaction(state transaction.TransactionState) *pb.Transaction {
+	tx := &pb.Transaction{
+		Id:          state.Id,
+		Type:        string(state.Type),
+		Status:      string(state.Status),
+		Timestamp:   timestamppb.New(state.Timestamp),
+		Coordinator: state.Coordinator,
+		Epoch:       state.Epoch,
+		Completed:   state.Completed,
+	}
+	if !state.Deadline.IsZero() {
+		tx.Deadline = timestamppb.New(state.Deadline)
+	}
+
+	for _, participant := range state.Participants {
+		tx.Participants = append(tx.Participants, &pb.Participant{
+			Name:   participant,
+			Status: string(state.ParticipantStatus[participant]),
+		})
+	}
+
+	return tx
+}
+
+func transactionError(err error) error {
+	switch {
+	case errors.Is(err, transaction.ErrTransactionNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, transaction.ErrAlreadyDecided), errors.Is(err, transaction.ErrNotReady):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// comparePage orders the <type>/<id> keys like the list, by the type order
+// first, the ids are zero padded sequence numbers
+func comparePage(a string, b string) int {
+	typeA, idA, _ := strings.Cut(a, "/")
+	typeB, idB, _ := strings.Cut(b, "/")
+
+	if typeA != typeB {
+		return typeIndex(typeA) - typeIndex(typeB)
+	}
+
+	return strings.Compare(idA, idB)
+}
+
+func typeIndex(txType string) int {
+	for i, t := range transaction.TransactionTypes {
+		if string(t) == txType {
+			return i
+		}
+	}
+
+	return len(transaction.TransactionTypes)
+}
+
+func encodePageToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodePageToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.Contains(string(key), "/") {
+		return "", fmt.Errorf("malformed key %s", key)
+	}
+
+	return string(key), nil
+}
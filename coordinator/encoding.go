@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"syscall"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+// e.g. TRANSACTION_CODEC=gzip+proto, the participants read every codec
+func codecFromEnv() transaction.Codec {
+	name, ok := syscall.Getenv("TRANSACTION_CODEC")
+	if !ok {
+		return transaction.JSONCodec
+	}
+
+	codec, ok := transaction.LookupCodec(name)
+	if !ok {
+		log.Fatalf("unknown TRANSACTION_CODEC %s\n", name)
+	}
+
+	return codec
+}
+
+func chunkSizeFromEnv() int {
+	value, ok := syscall.Getenv("PAYLOAD_CHUNK_SIZE")
+	if !ok {
+		return transaction.DefaultChunkSize
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid PAYLOAD_CHUNK_SIZE %s: %v\n", value, err)
+		return transaction.DefaultChunkSize
+	}
+
+	return size
+}
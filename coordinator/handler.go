@@ -3,12 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
 )
@@ -16,58 +21,347 @@ import (
 type grpcHandler struct {
 	pb.UnimplementedCoordinatorServiceServer
 
-	zkClient *zkclient.ZooKeeperClient
-	tw       transaction.TransactionWatcher
-	tm       transaction.TransactionManager
+	zkClient    *zkclient.ZooKeeperClient
+	tw          transaction.TransactionWatcher
+	tm          transaction.TransactionManager
+	orderClient pb.OrderServiceClient
 }
 
 func NewHandler(
 	server *grpc.Server,
 	zkClient *zkclient.ZooKeeperClient,
 	tw transaction.TransactionWatcher,
-	tm transaction.TransactionManager) {
+	tm transaction.TransactionManager,
+	orderClient pb.OrderServiceClient) {
 
 	handler := &grpcHandler{
-		tw:       tw,
-		tm:       tm,
-		zkClient: zkClient,
+		tw:          tw,
+		tm:          tm,
+		zkClient:    zkClient,
+		orderClient: orderClient,
 	}
 	pb.RegisterCoordinatorServiceServer(server, handler)
 }
 
 func (h *grpcHandler) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
 	log.Println("coordinator: place order request")
-	participants := []string{"order", "user"}
-	resources := []transaction.ResourceType{transaction.OrderResource, transaction.UserResource}
 
-	data, err := json.Marshal(req)
+	price, items, err := orderTotal(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// the payload leaves the request options out, so a retry has the same payload
+	data, err := json.Marshal(&pb.PlaceOrderRequest{UserId: req.UserId, Price: price, Items: items})
 	if err != nil {
 		return nil, fmt.Errorf("error in marshal place order request: %v", err)
 	}
 
-	txId, err := h.tm.Begin(transaction.OrderCreation, data, participants, resources)
+	resp, err := h.ExecuteTransaction(ctx, &pb.ExecuteTransactionRequest{
+		Type:    string(transaction.OrderCreation),
+		Payload: data,
+		ResourceKeys: map[string]string{
+			string(transaction.UserResource): req.UserId,
+		},
+		Options: &pb.TransactionOptions{Async: req.Async, IdempotencyKey: req.IdempotencyKey},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Async {
+		return &pb.PlaceOrderResponse{Message: "order accepted", Success: true, TransactionId: resp.TransactionId}, nil
+	}
+
+	if !resp.Committed {
+		code, message := abortReason(resp.Votes, "order place failed")
+		return &pb.PlaceOrderResponse{
+			Message:       message,
+			Success:       false,
+			TransactionId: resp.TransactionId,
+			ReasonCode:    code,
+			Votes:         resp.Votes,
+		}, nil
+	}
+
+	return &pb.PlaceOrderResponse{
+		Message:       "order placed successfully",
+		Success:       true,
+		TransactionId: resp.TransactionId,
+		Votes:         resp.Votes,
+	}, nil
+}
+
+func (h *grpcHandler) CancelOrder(ctx context.Context, req *pb.CancelOrderRequest) (*pb.CancelOrderResponse, error) {
+	log.Printf("coordinator: cancel order %s request\n", req.OrderId)
+
+	if req.OrderId == "" || req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "order id and user id are required")
+	}
+
+	// the order participant checks the amount, the owner and the status again
+	// while the order is locked
+	order, err := h.orderClient.GetOrder(ctx, &pb.GetOrderRequest{Id: req.OrderId})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error in get order %s: %v", req.OrderId, err)
+	}
+
+	data, err := json.Marshal(&pb.OrderRefund{OrderId: req.OrderId, UserId: req.UserId, Amount: order.Total, Items: order.Items})
+	if err != nil {
+		return nil, fmt.Errorf("error in marshal order refund: %v", err)
+	}
+
+	resp, err := h.ExecuteTransaction(ctx, &pb.ExecuteTransactionRequest{
+		Type:    string(transaction.OrderCancellation),
+		Payload: data,
+		ResourceKeys: map[string]string{
+			string(transaction.OrderResource): req.OrderId,
+			string(transaction.UserResource):  req.UserId,
+		},
+		Options: &pb.TransactionOptions{IdempotencyKey: req.IdempotencyKey},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Committed {
+		code, message := abortReason(resp.Votes, "order cancel failed")
+		return &pb.CancelOrderResponse{
+			Message:       message,
+			Success:       false,
+			TransactionId: resp.TransactionId,
+			ReasonCode:    code,
+			Votes:         resp.Votes,
+		}, nil
+	}
+
+	return &pb.CancelOrderResponse{
+		Message:       "order cancelled successfully",
+		Success:       true,
+		TransactionId: resp.TransactionId,
+		Votes:         resp.Votes,
+	}, nil
+}
+
+// abortReason returns the reason of the first participant which gave one,
+// it tells the client why the transaction was aborted
+func abortReason(votes []*pb.Vote, message string) (string, string) {
+	for _, vote := range votes {
+		if vote.ReasonCode != "" {
+			return vote.ReasonCode, vote.ReasonMessage
+		}
+	}
+
+	return "", message
+}
+
+// orderTotal computes the price of the items, the request price must
+// match it when both are given. The items fill the default currency in.
+func orderTotal(req *pb.PlaceOrderRequest) (*pb.Money, []*pb.LineItem, error) {
+	if len(req.Items) == 0 {
+		price := money.Normalize(req.Price)
+		if err := money.Validate(price); err != nil {
+			return nil, nil, err
+		}
+		return price, nil, nil
+	}
+
+	var total *pb.Money
+	items := make([]*pb.LineItem, 0, len(req.Items))
+	skus := make(map[string]bool, len(req.Items))
+	for _, item := range req.Items {
+		if item.Sku == "" {
+			return nil, nil, fmt.Errorf("missing item sku")
+		}
+		if skus[item.Sku] {
+			return nil, nil, fmt.Errorf("duplicate item %s", item.Sku)
+		}
+		skus[item.Sku] = true
+
+		unitPrice := money.Normalize(item.UnitPrice)
+		if item.Quantity <= 0 || money.Validate(unitPrice) != nil {
+			return nil, nil, fmt.Errorf("invalid quantity or unit price of item %s", item.Sku)
+		}
+		items = append(items, &pb.LineItem{Sku: item.Sku, Quantity: item.Quantity, UnitPrice: unitPrice})
+
+		subtotal, err := money.Mul(unitPrice, int64(item.Quantity))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error in price item %s: %v", item.Sku, err)
+		}
+		if total == nil {
+			total = money.New(0, unitPrice.Currency)
+		}
+		if total, err = money.Add(total, subtotal); err != nil {
+			return nil, nil, fmt.Errorf("error in price item %s: %v", item.Sku, err)
+		}
+	}
+
+	if req.Price != nil && req.Price.Amount != 0 && !money.Equal(money.Normalize(req.Price), total) {
+		return nil, nil, fmt.Errorf("price %s does not match the items total %s", money.String(money.Normalize(req.Price)), money.String(total))
+	}
+
+	return total, items, nil
+}
+
+func (h *grpcHandler) ExecuteTransaction(ctx context.Context, req *pb.ExecuteTransactionRequest) (*pb.ExecuteTransactionResponse, error) {
+	log.Printf("coordinator: execute %s transaction request\n", req.Type)
+
+	txType := transaction.TransactionType(req.Type)
+	spec, ok := transaction.LookupTransactionType(txType)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown transaction type %s", req.Type)
+	}
+
+	resources := make(map[transaction.ResourceType]string, len(spec.Resources))
+	for _, resource := range spec.Resources {
+		resources[resource] = ""
+	}
+	for resource, key := range req.ResourceKeys {
+		if _, ok := resources[transaction.ResourceType(resource)]; !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "resource %s not used by %s transactions", resource, req.Type)
+		}
+		resources[transaction.ResourceType(resource)] = key
+	}
+	participants := spec.ParticipantsFor(resources)
+
+	// the client deadline bounds the transaction, otherwise the type policy
+	// applies, an async client does not wait for the outcome
+	var err error
+	var deadline time.Time
+	if !req.GetOptions().GetAsync() {
+		deadline, _ = ctx.Deadline()
+	}
+	if timeout := req.GetOptions().GetTimeout(); timeout != nil {
+		if optionDeadline := time.Now().Add(timeout.AsDuration()); deadline.IsZero() || optionDeadline.Before(deadline) {
+			deadline = optionDeadline
+		}
+	}
+
+	var txId string
+	created := true
+	if key := req.GetOptions().GetIdempotencyKey(); key != "" {
+		txId, created, err = h.tm.BeginOnce(key, txType, req.Payload, participants, resources, deadline)
+	} else {
+		txId, err = h.tm.Begin(txType, req.Payload, participants, resources, deadline)
+	}
 	if err != nil {
+		if errors.Is(err, transaction.ErrIdempotencyConflict) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
 		return nil, fmt.Errorf("error in begin transaction: %v", err)
 	}
 
-	err = h.tm.Prepare(txId)
+	if !created {
+		return h.replay(ctx, txId, req.GetOptions().GetAsync())
+	}
+
+	if req.GetOptions().GetAsync() {
+		go h.runOrAbort(txId, participants)
+
+		return &pb.ExecuteTransactionResponse{TransactionId: txId, Outcome: "PENDING"}, nil
+	}
+
+	return h.runOrAbort(txId, participants)
+}
+
+// runOrAbort aborts a transaction whose run failed, so the participants do
+// not keep their prepared work until the leader expires it
+func (h *grpcHandler) runOrAbort(txId string, participants []string) (*pb.ExecuteTransactionResponse, error) {
+	resp, err := h.run(txId, participants)
+	if err != nil {
+		log.Printf("error in run transaction %s: %v\n", txId, err)
+		if _, err := h.tm.Finalize(txId, false); err != nil {
+			log.Printf("error in abort transaction %s: %v\n", txId, err)
+		}
+	}
+
+	return resp, err
+}
+
+// run drives a transaction which has begun through both phases
+func (h *grpcHandler) run(txId string, participants []string) (*pb.ExecuteTransactionResponse, error) {
+	err := h.tm.Prepare(txId)
 	if err != nil {
 		return nil, fmt.Errorf("error in prepare transaction: %v", err)
 	}
 
-	isCommit, err := h.tm.GetVotesResult(txId)
+	result, err := h.tm.GetVotesResult(txId)
 	if err != nil {
 		return nil, fmt.Errorf("error in get votes result: %v", err)
 	}
 
-	err = h.tm.Finalize(txId, isCommit)
+	isCommit, err := h.tm.Finalize(txId, result.Commit)
 	if err != nil {
 		return nil, fmt.Errorf("error in finalize transaction: %v", err)
 	}
 
-	if !isCommit {
-		return &pb.PlaceOrderResponse{Message: "order place failed", Success: false}, nil
+	resp := &pb.ExecuteTransactionResponse{
+		TransactionId: txId,
+		Outcome:       string(transaction.StatusRollBack),
+		Committed:     isCommit,
+	}
+	if isCommit {
+		resp.Outcome = string(transaction.StatusCommit)
+	}
+	for _, participant := range participants {
+		reason := result.Reasons[participant]
+		resp.Votes = append(resp.Votes, &pb.Vote{
+			Participant:   participant,
+			Status:        string(result.Votes[participant]),
+			ReasonCode:    reason.Code,
+			ReasonMessage: reason.Message,
+		})
+	}
+
+	return resp, nil
+}
+
+// replay answers a retried request with the transaction of the first one,
+// and waits for its decision unless the request is async. The votes are
+// the participant states at that time.
+func (h *grpcHandler) replay(ctx context.Context, txId string, async bool) (*pb.ExecuteTransactionResponse, error) {
+	var state transaction.TransactionState
+	if async {
+		var err error
+		if state, err = h.tm.GetTransaction(txId); err != nil {
+			return nil, fmt.Errorf("error in get transaction %s: %v", txId, err)
+		}
+	} else {
+		states, err := h.tm.WatchTransaction(txId, ctx.Done())
+		if err != nil {
+			return nil, fmt.Errorf("error in watch transaction %s: %v", txId, err)
+		}
+
+		for state = range states {
+			if state.Decided() {
+				break
+			}
+		}
+		if !state.Decided() && ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	resp := &pb.ExecuteTransactionResponse{TransactionId: txId, Outcome: "PENDING"}
+	if state.Decided() {
+		resp.Committed = state.Committed()
+		resp.Outcome = string(transaction.StatusRollBack)
+		if resp.Committed {
+			resp.Outcome = string(transaction.StatusCommit)
+		}
+	}
+	for _, participant := range state.Participants {
+		reason := state.ParticipantReasons[participant]
+		resp.Votes = append(resp.Votes, &pb.Vote{
+			Participant:   participant,
+			Status:        string(state.ParticipantStatus[participant]),
+			ReasonCode:    reason.Code,
+			ReasonMessage: reason.Message,
+		})
 	}
 
-	return &pb.PlaceOrderResponse{Message: "order placed successfully", Success: true}, nil
+	return resp, nil
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+// history searches the archived transactions, e.g.
+//
+//	coordinator history -keyword 04937668-e73f-4035-a7d7-8f8db1a679e8 -since 168h
+func history(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	id := flags.String("id", "", "transaction id")
+	txType := flags.String("type", "", "transaction type")
+	status := flags.String("status", "", "transaction decision")
+	keyword := flags.String("keyword", "", "text contained in the payload")
+	since := flags.Duration("since", 0, "only transactions begun within this duration")
+	flags.Parse(args)
+
+	query := transaction.TransactionQuery{
+		Id:      *id,
+		Type:    transaction.TransactionType(*txType),
+		Status:  transaction.TransactionStatus(*status),
+		Keyword: *keyword,
+	}
+	if *since > 0 {
+		query.Since = time.Now().Add(-*since)
+	}
+
+	records, err := archiverFromEnv().Search(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	for _, record := range records {
+		encoder.Encode(record)
+	}
+}
@@ -4,14 +4,28 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"syscall"
 
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
 	"google.golang.org/grpc"
 )
 
 func main() {
+	// the transactions of a user run on the shard of the user
+	transaction.LoadShards("user")
+
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		history(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		reconcile(os.Args[2:])
+		return
+	}
+
 	host, ok := syscall.Getenv("HOST")
 	if !ok {
 		host = "127.0.0.1"
@@ -23,12 +37,12 @@ func main() {
 	}
 	defer listen.Close()
 
-	zkServer, ok := syscall.Getenv("ZK_SERVER")
-	if !ok {
-		zkServer = "127.0.0.1:2181"
+	zkConfig, err := zkclient.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	zkClient, err := zkclient.NewZooKeeperClient([]string{zkServer})
+	zkClient, err := zkclient.NewZooKeeperClient(zkConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -38,15 +52,24 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	tm.SetRetention(retentionPolicyFromEnv(), archiverFromEnv())
+	tm.SetEncoding(codecFromEnv(), chunkSizeFromEnv())
+	tm.SetIdempotencyWindow(idempotencyWindowFromEnv())
+	tm.Run()
+	defer tm.Stop()
 
-	tw, err := transaction.NewTransactionWatcher(zkClient)
+	tw, err := transaction.NewTransactionWatcher(zkClient, "coordinator")
 	defer tw.Stop()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	orderServiceClientConn := dial("ORDER_SERVICE", "127.0.0.1:8081")
+	defer orderServiceClientConn.Close()
+
 	server := grpc.NewServer()
-	NewHandler(server, zkClient, tw, tm)
+	NewHandler(server, zkClient, tw, tm, pb.NewOrderServiceClient(orderServiceClientConn))
+	NewAdminHandler(server, tm, tm)
 
 	log.Printf("Coordinator service started at %s:8082\n", host)
 
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+// the kinds of disagreement reported by reconcile
+const (
+	OrderWithoutDebit    = "ORDER_WITHOUT_DEBIT"
+	DebitWithoutOrder    = "DEBIT_WITHOUT_ORDER"
+	AmountMismatch       = "AMOUNT_MISMATCH"
+	RolledBackButApplied = "ROLLED_BACK_BUT_APPLIED"
+)
+
+// Finding is a transaction on which the order and the user databases, or
+// the archived decision, disagree. Refund is the compensation of -fix, in
+// the currency of the debit.
+type Finding struct {
+	Kind          string    `json:"kind"`
+	TransactionId string    `json:"transaction_id"`
+	OrderId       string    `json:"order_id,omitempty"`
+	UserId        string    `json:"user_id,omitempty"`
+	OrderTotal    *pb.Money `json:"order_total,omitempty"`
+	Debit         *pb.Money `json:"debit,omitempty"`
+	Decision      string    `json:"decision,omitempty"`
+	Refund        int64     `json:"refund,omitempty"`
+	RefundTxId    string    `json:"refund_transaction_id,omitempty"`
+}
+
+// reconcile joins the orders with the ledger debits of ORDER_CREATION
+// transactions and their archived decisions by transaction id, e.g.
+//
+//	coordinator reconcile -since 168h
+//	coordinator reconcile -since 168h -fix
+//
+// An order is created at prepare and its debit is written at commit, so one
+// of them may fall out of the window, the side without a match is looked up
+// by transaction id in the other service.
+//
+// With -fix an over-charged user is refunded with a WALLET_TOPUP through the
+// coordinator. The refund is keyed by the transaction id, so running it
+// again is safe as long as -since stays within IDEMPOTENCY_WINDOW. The other
+// findings need an operator.
+func reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	since := flags.Duration("since", 24*time.Hour, "only orders and debits made within this duration")
+	settle := flags.Duration("settle", time.Minute, "skip the orders and debits younger than this, their transactions may still run")
+	fix := flags.Bool("fix", false, "refund the over-charged users through the coordinator")
+	flags.Parse(args)
+
+	if *fix && *since > idempotencyWindowFromEnv() {
+		log.Fatalf("-since %s exceeds the idempotency window, a refund could be applied twice", *since)
+	}
+
+	ctx := context.Background()
+	from, until := time.Now().Add(-*since), time.Now().Add(-*settle)
+
+	orderConn := dial("ORDER_SERVICE", "127.0.0.1:8081")
+	defer orderConn.Close()
+	orderClient := pb.NewOrderServiceClient(orderConn)
+
+	// the debits are spread over the user shards of the comma separated list
+	addrs, ok := syscall.Getenv("USER_SERVICE")
+	if !ok {
+		addrs = "127.0.0.1:8080"
+	}
+	var userClients []pb.UserServiceClient
+	for _, addr := range strings.Split(addrs, ",") {
+		conn := dialAddr(strings.TrimSpace(addr))
+		defer conn.Close()
+		userClients = append(userClients, pb.NewUserServiceClient(conn))
+	}
+
+	orders, err := loadOrders(ctx, orderClient, from, until)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	debits := make(map[string]*pb.LedgerEntry)
+	for _, userClient := range userClients {
+		if err := loadDebits(ctx, userClient, from, until, debits); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := joinOrders(ctx, orderClient, orders, debits); err != nil {
+		log.Fatal(err)
+	}
+	if err := joinDebits(ctx, userClients, orders, debits); err != nil {
+		log.Fatal(err)
+	}
+
+	// a transaction begins before its order is created, within its timeout
+	begunSince := from
+	for _, order := range orders {
+		if createdAt := order.CreatedAt.AsTime(); order.CreatedAt != nil && createdAt.Before(begunSince) {
+			begunSince = createdAt
+		}
+	}
+	if spec, ok := transaction.LookupTransactionType(transaction.OrderCreation); ok {
+		begunSince = begunSince.Add(-spec.Policy.Timeout)
+	}
+
+	records, err := archiverFromEnv().Search(transaction.TransactionQuery{Type: transaction.OrderCreation, Since: begunSince})
+	if err != nil {
+		log.Fatal(err)
+	}
+	decisions := make(map[string]transaction.TransactionStatus, len(records))
+	for _, record := range records {
+		decisions[record.Id] = record.Status
+	}
+
+	findings := compare(orders, debits, decisions)
+
+	if *fix {
+		host, ok := syscall.Getenv("HOST")
+		if !ok {
+			host = "127.0.0.1"
+		}
+		coordinator := dial("COORDINATOR_SERVICE", host+":8082")
+		client := pb.NewCoordinatorServiceClient(coordinator)
+		defer coordinator.Close()
+
+		for i := range findings {
+			refund(ctx, client, orderClient, &findings[i])
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, finding := range findings {
+		encoder.Encode(finding)
+	}
+	log.Printf("reconciled %d orders and %d debits, %d findings\n", len(orders), len(debits), len(findings))
+}
+
+func compare(orders map[string]*pb.Order, debits map[string]*pb.LedgerEntry, decisions map[string]transaction.TransactionStatus) []Finding {
+	ids := make(map[string]bool, len(orders)+len(debits))
+	for txId := range orders {
+		ids[txId] = true
+	}
+	for txId := range debits {
+		ids[txId] = true
+	}
+
+	var findings []Finding
+	for txId := range ids {
+		order, debit := orders[txId], debits[txId]
+		finding := Finding{TransactionId: txId, Decision: string(decisions[txId])}
+		if order != nil {
+			finding.OrderId, finding.UserId, finding.OrderTotal = order.Id, order.UserId, order.Total
+		}
+		if debit != nil {
+			finding.UserId, finding.Debit = debit.UserId, debit.Amount
+		}
+
+		// an archived roll back must have left nothing behind, the order or
+		// the debit was applied by hand
+		decision, archived := decisions[txId]
+		switch {
+		case archived && decision != transaction.StatusCommit && decision != transaction.StatusCommitted:
+			finding.Kind = RolledBackButApplied
+		case debit == nil:
+			finding.Kind = OrderWithoutDebit
+		case order == nil:
+			finding.Kind = DebitWithoutOrder
+		case !money.Equal(order.Total, debit.Amount):
+			finding.Kind = AmountMismatch
+		default:
+			continue
+		}
+
+		findings = append(findings, finding)
+	}
+
+	sort.Slice(findings, func(i, j int) bool { return findings[i].TransactionId < findings[j].TransactionId })
+
+	return findings
+}
+
+// refund gives the user back what was debited without an order
+func refund(ctx context.Context, client pb.CoordinatorServiceClient, orderClient pb.OrderServiceClient, finding *Finding) {
+	// a total in another currency than the debit needs an operator
+	switch {
+	case finding.Kind == DebitWithoutOrder || finding.Kind == RolledBackButApplied:
+		finding.Refund = finding.Debit.GetAmount()
+	case finding.Kind == AmountMismatch && finding.OrderTotal.GetCurrency() == finding.Debit.GetCurrency():
+		finding.Refund = finding.Debit.GetAmount() - finding.OrderTotal.GetAmount()
+	}
+	if finding.Refund <= 0 || finding.UserId == "" {
+		finding.Refund = 0
+		return
+	}
+
+	// the order may have been written since it was looked up, the user is
+	// never refunded for an order which exists
+	if finding.Kind == DebitWithoutOrder {
+		order, err := lookupOrder(ctx, orderClient, finding.TransactionId)
+		if err != nil || order != nil {
+			log.Printf("skip refund transaction %s, its order is not known to be missing: %v\n", finding.TransactionId, err)
+			finding.Refund = 0
+			return
+		}
+	}
+
+	resp, err := client.TopUp(ctx, &pb.TopUpRequest{
+		UserId:         finding.UserId,
+		Amount:         money.New(finding.Refund, finding.Debit.GetCurrency()),
+		IdempotencyKey: "reconcile/" + finding.TransactionId,
+	})
+	if err != nil {
+		log.Printf("error in refund transaction %s: %v\n", finding.TransactionId, err)
+		finding.Refund = 0
+		return
+	}
+	if !resp.Success {
+		log.Printf("refund transaction %s aborted: %s\n", finding.TransactionId, resp.Message)
+		finding.Refund = 0
+		return
+	}
+
+	finding.RefundTxId = resp.TransactionId
+}
+
+// loadOrders returns the orders created in the window by transaction id
+func loadOrders(ctx context.Context, client pb.OrderServiceClient, from time.Time, until time.Time) (map[string]*pb.Order, error) {
+	orders := make(map[string]*pb.Order)
+	req := &pb.ListOrdersRequest{
+		CreatedAfter:  timestamppb.New(from),
+		CreatedBefore: timestamppb.New(until),
+		PageSize:      500,
+	}
+	for {
+		resp, err := client.ListOrders(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, order := range resp.Orders {
+			if order.TransactionId != "" {
+				orders[order.TransactionId] = order
+			}
+		}
+
+		if resp.NextPageToken == "" {
+			return orders, nil
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+// loadDebits adds the ORDER_CREATION debits made in the window by
+// transaction id, the ledger is paged from the newest entry
+func loadDebits(ctx context.Context, client pb.UserServiceClient, from time.Time, until time.Time, debits map[string]*pb.LedgerEntry) error {
+	req := &pb.GetLedgerRequest{TransactionType: string(transaction.OrderCreation), PageSize: 500}
+	for {
+		resp, err := client.GetLedger(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range resp.Entries {
+			createdAt := entry.CreatedAt.AsTime()
+			if createdAt.Before(from) {
+				return nil
+			}
+			if entry.Direction == "DEBIT" && createdAt.Before(until) {
+				debits[entry.TransactionId] = entry
+			}
+		}
+
+		if resp.NextPageToken == "" {
+			return nil
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+// joinOrders looks up the order of every debit whose order is not in the window
+func joinOrders(ctx context.Context, client pb.OrderServiceClient, orders map[string]*pb.Order, debits map[string]*pb.LedgerEntry) error {
+	for txId := range debits {
+		if orders[txId] != nil {
+			continue
+		}
+
+		order, err := lookupOrder(ctx, client, txId)
+		if err != nil {
+			return err
+		}
+		if order != nil {
+			orders[txId] = order
+		}
+	}
+
+	return nil
+}
+
+// joinDebits looks up the debit of every order whose debit is not in the
+// window, on every user shard
+func joinDebits(ctx context.Context, clients []pb.UserServiceClient, orders map[string]*pb.Order, debits map[string]*pb.LedgerEntry) error {
+	for txId := range orders {
+		if debits[txId] != nil {
+			continue
+		}
+
+		for _, client := range clients {
+			debit, err := lookupDebit(ctx, client, txId)
+			if err != nil {
+				return err
+			}
+			if debit != nil {
+				debits[txId] = debit
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func lookupOrder(ctx context.Context, client pb.OrderServiceClient, txId string) (*pb.Order, error) {
+	resp, err := client.ListOrders(ctx, &pb.ListOrdersRequest{TransactionId: txId, PageSize: 1})
+	if err != nil {
+		return nil, fmt.Errorf("error in lookup order of transaction %s: %v", txId, err)
+	}
+	if len(resp.Orders) == 0 {
+		return nil, nil
+	}
+
+	return resp.Orders[0], nil
+}
+
+func lookupDebit(ctx context.Context, client pb.UserServiceClient, txId string) (*pb.LedgerEntry, error) {
+	req := &pb.GetLedgerRequest{TransactionType: string(transaction.OrderCreation), TransactionId: txId}
+	resp, err := client.GetLedger(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error in lookup debit of transaction %s: %v", txId, err)
+	}
+
+	for _, entry := range resp.Entries {
+		if entry.Direction == "DEBIT" {
+			return entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func dial(env string, fallback string) *grpc.ClientConn {
+	addr, ok := syscall.Getenv(env)
+	if !ok {
+		addr = fallback
+	}
+
+	return dialAddr(addr)
+}
+
+func dialAddr(addr string) *grpc.ClientConn {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return conn
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+func retentionPolicyFromEnv() transaction.RetentionPolicy {
+	policy := transaction.DefaultRetentionPolicy
+
+	if value, ok := syscall.Getenv("RETENTION_MAX_AGE"); ok {
+		policy.MaxAge = parseDuration("RETENTION_MAX_AGE", value, policy.MaxAge)
+	}
+
+	if value, ok := syscall.Getenv("RETENTION_STALE_AGE"); ok {
+		policy.StaleAge = parseDuration("RETENTION_STALE_AGE", value, policy.StaleAge)
+	}
+
+	// stale transactions are kept unless an operator purges them
+	if value, ok := syscall.Getenv("RETENTION_PURGE_STALE"); ok {
+		purge, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("invalid RETENTION_PURGE_STALE %s: %v\n", value, err)
+		} else {
+			policy.PurgeStale = purge
+		}
+	}
+
+	if value, ok := syscall.Getenv("RETENTION_MAX_COUNT"); ok {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("invalid RETENTION_MAX_COUNT %s: %v\n", value, err)
+		} else {
+			policy.MaxCount = count
+		}
+	}
+
+	// e.g. RETENTION_STATUSES=COMMIT,ROLL_BACK
+	if value, ok := syscall.Getenv("RETENTION_STATUSES"); ok && value != "" {
+		policy.Statuses = nil
+		for _, status := range strings.Split(value, ",") {
+			policy.Statuses = append(policy.Statuses, transaction.TransactionStatus(strings.TrimSpace(status)))
+		}
+	}
+
+	return policy
+}
+
+func idempotencyWindowFromEnv() time.Duration {
+	value, ok := syscall.Getenv("IDEMPOTENCY_WINDOW")
+	if !ok {
+		return transaction.DefaultIdempotencyWindow
+	}
+
+	return parseDuration("IDEMPOTENCY_WINDOW", value, transaction.DefaultIdempotencyWindow)
+}
+
+func archiverFromEnv() transaction.Archiver {
+	path, ok := syscall.Getenv("ARCHIVE_FILE")
+	if !ok {
+		path = "transactions.jsonl"
+	}
+
+	archiver, err := transaction.NewFileArchiver(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return archiver
+}
+
+func parseDuration(name string, value string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid %s %s: %v\n", name, value, err)
+		return fallback
+	}
+
+	return duration
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+func (h *grpcHandler) TopUp(ctx context.Context, req *pb.TopUpRequest) (*pb.WalletResponse, error) {
+	log.Printf("coordinator: top up %s request\n", req.UserId)
+
+	amount := money.Normalize(req.Amount)
+	if req.UserId == "" || money.Validate(amount) != nil || amount.Amount == 0 {
+		return nil, status.Error(codes.InvalidArgument, "user id and a positive amount are required")
+	}
+
+	// the payload leaves the idempotency key out, so a retry has the same payload
+	data, err := json.Marshal(&pb.TopUpRequest{UserId: req.UserId, Amount: amount})
+	if err != nil {
+		return nil, fmt.Errorf("error in marshal top up request: %v", err)
+	}
+
+	return h.executeWallet(ctx, &pb.ExecuteTransactionRequest{
+		Type:    string(transaction.WalletTopUp),
+		Payload: data,
+		ResourceKeys: map[string]string{
+			string(transaction.UserResource): req.UserId,
+		},
+		Options: &pb.TransactionOptions{IdempotencyKey: req.IdempotencyKey},
+	}, "top up")
+}
+
+// Transfer debits the payer and credits the payee, the shard of each wallet
+// takes part with its own hold
+func (h *grpcHandler) Transfer(ctx context.Context, req *pb.TransferRequest) (*pb.WalletResponse, error) {
+	log.Printf("coordinator: transfer %s to %s request\n", req.FromUserId, req.ToUserId)
+
+	amount := money.Normalize(req.Amount)
+	if req.FromUserId == "" || req.ToUserId == "" || money.Validate(amount) != nil || amount.Amount == 0 {
+		return nil, status.Error(codes.InvalidArgument, "user ids and a positive amount are required")
+	}
+	if req.FromUserId == req.ToUserId {
+		return nil, status.Error(codes.InvalidArgument, "cannot transfer to the same user")
+	}
+
+	data, err := json.Marshal(&pb.TransferRequest{FromUserId: req.FromUserId, ToUserId: req.ToUserId, Amount: amount})
+	if err != nil {
+		return nil, fmt.Errorf("error in marshal transfer request: %v", err)
+	}
+
+	return h.executeWallet(ctx, &pb.ExecuteTransactionRequest{
+		Type:    string(transaction.WalletTransfer),
+		Payload: data,
+		ResourceKeys: map[string]string{
+			string(transaction.UserResource):  req.FromUserId,
+			string(transaction.PayeeResource): req.ToUserId,
+		},
+		Options: &pb.TransactionOptions{IdempotencyKey: req.IdempotencyKey},
+	}, "transfer")
+}
+
+func (h *grpcHandler) executeWallet(ctx context.Context, req *pb.ExecuteTransactionRequest, action string) (*pb.WalletResponse, error) {
+	resp, err := h.ExecuteTransaction(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Committed {
+		code, message := abortReason(resp.Votes, action+" failed")
+		return &pb.WalletResponse{
+			Message:       message,
+			Success:       false,
+			TransactionId: resp.TransactionId,
+			ReasonCode:    code,
+			Votes:         resp.Votes,
+		}, nil
+	}
+
+	return &pb.WalletResponse{
+		Message:       action + " succeeded",
+		Success:       true,
+		TransactionId: resp.TransactionId,
+		Votes:         resp.Votes,
+	}, nil
+}
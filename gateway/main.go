@@ -3,46 +3,155 @@ package main
 import (
 	"log"
 	"net/http"
+	"strings"
 	"syscall"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/rest"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
 )
 
 var (
 	coordinatorServiceClient pb.CoordinatorServiceClient
-	userServiceClient        pb.UserServiceClient
+	userServiceClients       map[string]pb.UserServiceClient
 	orderServiceClient       pb.OrderServiceClient
+	inventoryServiceClient   pb.InventoryServiceClient
+	adminServiceClient       pb.TransactionAdminServiceClient
 )
 
 // can try user id 04937668-e73f-4035-a7d7-8f8db1a679e8
+// with ?async=true the order is accepted right away, and followed on
+// /v1/transactions/{id}. A retry with the same Idempotency-Key header gets
+// the outcome of the first request.
 func CreateOrder(w http.ResponseWriter, r *http.Request) {
 	var orderReq *pb.PlaceOrderRequest
 	if err := rest.ReadJSON(r, &orderReq); err != nil {
 		rest.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if r.URL.Query().Get("async") == "true" {
+		orderReq.Async = true
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		orderReq.IdempotencyKey = key
+	}
 
 	resp, err := coordinatorServiceClient.PlaceOrder(r.Context(), orderReq)
 	if err != nil {
+		// the idempotency key was used for another order
+		if status.Code(err) == codes.FailedPrecondition {
+			rest.WriteError(w, http.StatusConflict, status.Convert(err).Message())
+			return
+		}
+		if status.Code(err) == codes.InvalidArgument {
+			rest.WriteError(w, http.StatusBadRequest, status.Convert(err).Message())
+			return
+		}
 		rest.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if orderReq.Async {
+		w.Header().Set("Location", "/v1/transactions/"+resp.TransactionId)
+		rest.WriteJSON(w, http.StatusAccepted, map[string]string{
+			"message":        "Order accepted",
+			"status":         "pending",
+			"transaction_id": resp.TransactionId,
+		})
+		return
+	}
+
+	if !resp.Success {
+		writeAbort(w, resp.ReasonCode, resp.Message, resp.TransactionId)
+		return
+	}
+
+	rest.WriteJSON(w, http.StatusOK, map[string]string{
+		"message":        "Order created",
+		"status":         "success",
+		"transaction_id": resp.TransactionId,
+	})
+}
+
+// CancelOrder cancels an order of the user in the body and refunds its price
+func CancelOrder(w http.ResponseWriter, r *http.Request) {
+	var cancelReq *pb.CancelOrderRequest
+	if err := rest.ReadJSON(r, &cancelReq); err != nil {
+		rest.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cancelReq.OrderId = r.PathValue("id")
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		cancelReq.IdempotencyKey = key
+	}
+
+	resp, err := coordinatorServiceClient.CancelOrder(r.Context(), cancelReq)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.NotFound:
+			rest.WriteError(w, http.StatusNotFound, status.Convert(err).Message())
+		case codes.InvalidArgument:
+			rest.WriteError(w, http.StatusBadRequest, status.Convert(err).Message())
+		case codes.FailedPrecondition:
+			rest.WriteError(w, http.StatusConflict, status.Convert(err).Message())
+		default:
+			rest.WriteError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
 	if !resp.Success {
-		rest.WriteError(w, http.StatusBadRequest, resp.Message)
+		writeAbort(w, resp.ReasonCode, resp.Message, resp.TransactionId)
 		return
 	}
 
 	rest.WriteJSON(w, http.StatusOK, map[string]string{
-		"message": "Order created",
-		"status":  "success",
+		"message":        "Order cancelled",
+		"status":         "success",
+		"transaction_id": resp.TransactionId,
 	})
 }
 
+// writeAbort answers a transaction which was aborted with its reason
+func writeAbort(w http.ResponseWriter, reasonCode string, message string, txId string) {
+	rest.WriteJSON(w, abortStatus(reasonCode), map[string]string{
+		"message":        message,
+		"status":         "error",
+		"reason":         reasonCode,
+		"transaction_id": txId,
+	})
+}
+
+// abortStatus maps the abort reason of an order to its HTTP status
+func abortStatus(reasonCode string) int {
+	switch reasonCode {
+	case transaction.ReasonInsufficientFunds:
+		return http.StatusPaymentRequired
+	case transaction.ReasonUserNotFound, transaction.ReasonUnknownSku, transaction.ReasonOrderNotFound:
+		return http.StatusNotFound
+	case transaction.ReasonOrderNotOwned:
+		return http.StatusForbidden
+	case transaction.ReasonOutOfStock, transaction.ReasonOrderCancelled, transaction.ReasonOrderNotConfirmed:
+		return http.StatusConflict
+	case transaction.ReasonCurrencyMismatch, transaction.ReasonAmountOverflow:
+		return http.StatusUnprocessableEntity
+	case transaction.ReasonExpired, transaction.ReasonVoteTimeout:
+		return http.StatusGatewayTimeout
+	case transaction.ReasonInternal, "":
+		// a participant or its database failed, not the request
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusBadRequest
+}
+
 func GetUser(w http.ResponseWriter, r *http.Request) {
 	userId := r.PathValue("id")
 	if userId == "" {
@@ -50,23 +159,51 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := userServiceClient.GetUser(r.Context(), &pb.GetUserRequest{UserId: userId})
+	user, err := userClientFor(userId).GetUser(r.Context(), &pb.GetUserRequest{UserId: userId})
 	if err != nil {
-		rest.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeUserError(w, err)
 		return
 	}
 
 	rest.WriteJSON(w, http.StatusOK, user)
 }
 
-func GetOrders(w http.ResponseWriter, r *http.Request) {
-	orders, err := orderServiceClient.GetOrders(r.Context(), nil)
+func GetStock(w http.ResponseWriter, r *http.Request) {
+	sku := r.PathValue("sku")
+	if sku == "" {
+		rest.WriteError(w, http.StatusBadRequest, "missing sku")
+		return
+	}
+
+	stock, err := inventoryServiceClient.GetStock(r.Context(), &pb.GetStockRequest{Sku: sku})
 	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			rest.WriteError(w, http.StatusNotFound, status.Convert(err).Message())
+			return
+		}
 		rest.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	rest.WriteJSON(w, http.StatusOK, orders)
+	rest.WriteJSON(w, http.StatusOK, stock)
+}
+
+// dialCoordinators balances the requests over the coordinator replicas of
+// the comma separated list, a replica which is down is skipped
+func dialCoordinators(addrs string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	var state resolver.State
+	for _, addr := range strings.Split(addrs, ",") {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: strings.TrimSpace(addr)})
+	}
+
+	r := manual.NewBuilderWithScheme("coordinators")
+	r.InitialState(state)
+	opts = append(opts,
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`),
+	)
+
+	return grpc.NewClient(r.Scheme()+":///coordinator", opts...)
 }
 
 func main() {
@@ -85,15 +222,20 @@ func main() {
 		orderServiceAddr = "127.0.0.1:8081"
 	}
 
+	inventoryServiceAddr, ok := syscall.Getenv("INVENTORY_SERVICE")
+	if !ok {
+		inventoryServiceAddr = "127.0.0.1:8083"
+	}
+
 	mux := http.NewServeMux()
 
 	var opts []grpc.DialOption
 	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	coordinatorServiceClientConn, err := grpc.NewClient(coordinatorServiceAddr, opts...)
+	coordinatorServiceClientConn, err := dialCoordinators(coordinatorServiceAddr, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	userServiceClientConn, err := grpc.NewClient(userServiceAddr, opts...)
+	userServiceClients, err = dialUserShards(userServiceAddr, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -101,14 +243,31 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	inventoryServiceClientConn, err := grpc.NewClient(inventoryServiceAddr, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	coordinatorServiceClient = pb.NewCoordinatorServiceClient(coordinatorServiceClientConn)
-	userServiceClient = pb.NewUserServiceClient(userServiceClientConn)
 	orderServiceClient = pb.NewOrderServiceClient(orderServiceClientConn)
+	inventoryServiceClient = pb.NewInventoryServiceClient(inventoryServiceClientConn)
+	adminServiceClient = pb.NewTransactionAdminServiceClient(coordinatorServiceClientConn)
 
 	mux.HandleFunc("POST /v1/order", CreateOrder)
+	mux.HandleFunc("POST /v1/user", CreateUser)
+	mux.HandleFunc("GET /v1/user", ListUsers)
 	mux.HandleFunc("GET /v1/user/{id}", GetUser)
-	mux.HandleFunc("GET /v1/order", GetOrders)
+	mux.HandleFunc("PATCH /v1/user/{id}", UpdateUser)
+	mux.HandleFunc("GET /v1/user/{id}/orders", ListOrders)
+	mux.HandleFunc("GET /v1/user/{id}/ledger", GetLedger)
+	mux.HandleFunc("POST /v1/user/{id}/topup", TopUp)
+	mux.HandleFunc("POST /v1/user/{id}/transfer", Transfer)
+	mux.HandleFunc("POST /v1/order/{id}/cancel", CancelOrder)
+	mux.HandleFunc("GET /v1/order", ListOrders)
+	mux.HandleFunc("GET /v1/order/{id}", GetOrder)
+	mux.HandleFunc("GET /v1/inventory/{sku}", GetStock)
+	mux.HandleFunc("GET /v1/transactions/{id}", GetTransaction)
+	mux.HandleFunc("GET /v1/transactions/{id}/events", WatchTransaction)
 
 	log.Println("Starting HTTP server at 127.0.0.1:8000")
 	if err := http.ListenAndServe(":8000", mux); err != nil {
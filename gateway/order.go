@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/rest"
+)
+
+func GetOrder(w http.ResponseWriter, r *http.Request) {
+	order, err := orderServiceClient.GetOrder(r.Context(), &pb.GetOrderRequest{Id: r.PathValue("id")})
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
+	writeProto(w, order)
+}
+
+// ListOrders serves /v1/order and /v1/user/{id}/orders, filtered by
+// ?user_id=&status=&since=&until=&currency=&min_total=&max_total=, the
+// totals in minor units, sorted by
+// ?sort=created_at|total&desc=true and paged by ?page_size=&page_token=
+func ListOrders(w http.ResponseWriter, r *http.Request) {
+	listReq, err := listOrdersRequest(r.URL.Query())
+	if err != nil {
+		rest.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if userId := r.PathValue("id"); userId != "" {
+		listReq.UserId = userId
+	}
+
+	orders, err := orderServiceClient.ListOrders(r.Context(), listReq)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
+	writeProto(w, orders)
+}
+
+func listOrdersRequest(query url.Values) (*pb.ListOrdersRequest, error) {
+	listReq := &pb.ListOrdersRequest{
+		UserId:    query.Get("user_id"),
+		Status:    query.Get("status"),
+		Currency:  query.Get("currency"),
+		SortBy:    query.Get("sort"),
+		PageToken: query.Get("page_token"),
+	}
+
+	for name, field := range map[string]**timestamppb.Timestamp{
+		"since": &listReq.CreatedAfter,
+		"until": &listReq.CreatedBefore,
+	} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s, expected RFC 3339 time", name)
+			}
+			*field = timestamppb.New(t)
+		}
+	}
+
+	for name, field := range map[string]**int64{
+		"min_total": &listReq.MinTotal,
+		"max_total": &listReq.MaxTotal,
+	} {
+		if value := query.Get(name); value != "" {
+			total, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", name)
+			}
+			*field = &total
+		}
+	}
+
+	if value := query.Get("page_size"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid page_size")
+		}
+		listReq.PageSize = int32(n)
+	}
+
+	if value := query.Get("desc"); value != "" {
+		desc, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid desc")
+		}
+		listReq.Descending = desc
+	}
+
+	return listReq, nil
+}
+
+func writeOrderError(w http.ResponseWriter, err error) {
+	switch status.Code(err) {
+	case codes.NotFound:
+		rest.WriteError(w, http.StatusNotFound, status.Convert(err).Message())
+	case codes.InvalidArgument:
+		rest.WriteError(w, http.StatusBadRequest, status.Convert(err).Message())
+	default:
+		rest.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/rest"
+)
+
+var protoJSON = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+
+// writeProto renders a message with the proto field names
+func writeProto(w http.ResponseWriter, message proto.Message) {
+	data, err := protoJSON.Marshal(message)
+	if err != nil {
+		rest.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rest.WriteJSON(w, http.StatusOK, json.RawMessage(data))
+}
+
+func GetTransaction(w http.ResponseWriter, r *http.Request) {
+	txId := r.PathValue("id")
+	if txId == "" {
+		rest.WriteError(w, http.StatusBadRequest, "missing transaction id")
+		return
+	}
+
+	tx, err := adminServiceClient.GetTransaction(r.Context(), &pb.GetTransactionRequest{Id: txId})
+	if err != nil {
+		writeTransactionError(w, err)
+		return
+	}
+
+	writeProto(w, tx)
+}
+
+// WatchTransaction streams the transaction progress as server-sent events,
+// one transaction event per state transition until it completes.
+func WatchTransaction(w http.ResponseWriter, r *http.Request) {
+	txId := r.PathValue("id")
+	if txId == "" {
+		rest.WriteError(w, http.StatusBadRequest, "missing transaction id")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		rest.WriteError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	stream, err := adminServiceClient.WatchTransaction(r.Context(), &pb.WatchTransactionRequest{Id: txId})
+	if err != nil {
+		writeTransactionError(w, err)
+		return
+	}
+
+	// the stream reports an unknown transaction on its first message
+	tx, err := stream.Recv()
+	if err != nil {
+		writeTransactionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		data, err := protoJSON.Marshal(tx)
+		if err != nil {
+			log.Printf("error in marshal transaction %s: %v\n", txId, err)
+			return
+		}
+		fmt.Fprintf(w, "event: transaction\ndata: %s\n\n", data)
+		flusher.Flush()
+
+		tx, err = stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", status.Convert(err).Message())
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+func writeTransactionError(w http.ResponseWriter, err error) {
+	if status.Code(err) == codes.NotFound {
+		rest.WriteError(w, http.StatusNotFound, status.Convert(err).Message())
+		return
+	}
+
+	rest.WriteError(w, http.StatusInternalServerError, err.Error())
+}
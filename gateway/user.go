@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/rest"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+func CreateUser(w http.ResponseWriter, r *http.Request) {
+	var createReq *pb.CreateUserRequest
+	if err := rest.ReadJSON(r, &createReq); err != nil {
+		rest.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// a user without an id is created on any shard, which draws an id it owns
+	client := userClientFor(createReq.Id)
+	if createReq.Id == "" {
+		client = userServiceClients[userShards[rand.IntN(len(userShards))]]
+	}
+
+	user, err := client.CreateUser(r.Context(), createReq)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/user/"+user.Id)
+	rest.WriteJSON(w, http.StatusCreated, user)
+}
+
+// ListUsers pages the users with ?page_size=&page_token=
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	listReq := &pb.ListUsersRequest{PageToken: r.URL.Query().Get("page_token")}
+	if pageSize := r.URL.Query().Get("page_size"); pageSize != "" {
+		size, err := strconv.Atoi(pageSize)
+		if err != nil {
+			rest.WriteError(w, http.StatusBadRequest, "invalid page size")
+			return
+		}
+		listReq.PageSize = int32(size)
+	}
+
+	users, err := listUserShards(r.Context(), listReq)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	writeProto(w, users)
+}
+
+func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var updateReq *pb.UpdateUserRequest
+	if err := rest.ReadJSON(r, &updateReq); err != nil {
+		rest.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	updateReq.UserId = r.PathValue("id")
+
+	user, err := userClientFor(updateReq.UserId).UpdateUser(r.Context(), updateReq)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	rest.WriteJSON(w, http.StatusOK, user)
+}
+
+// GetLedger pages the balance changes of the user, the newest first
+func GetLedger(w http.ResponseWriter, r *http.Request) {
+	ledgerReq := &pb.GetLedgerRequest{UserId: r.PathValue("id"), PageToken: r.URL.Query().Get("page_token")}
+	if pageSize := r.URL.Query().Get("page_size"); pageSize != "" {
+		size, err := strconv.Atoi(pageSize)
+		if err != nil {
+			rest.WriteError(w, http.StatusBadRequest, "invalid page size")
+			return
+		}
+		ledgerReq.PageSize = int32(size)
+	}
+
+	ledger, err := userClientFor(ledgerReq.UserId).GetLedger(r.Context(), ledgerReq)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	writeProto(w, ledger)
+}
+
+// userShards keeps the order of USER_SHARDS, the n-th address of
+// USER_SERVICE serves the n-th shard
+var userShards []string
+
+func dialUserShards(addrs string, opts ...grpc.DialOption) (map[string]pb.UserServiceClient, error) {
+	userShards = transaction.LoadShards("user")
+	list := strings.Split(addrs, ",")
+	if len(list) != len(userShards) {
+		return nil, fmt.Errorf("error in dial user shards: %d addresses for the shards %v", len(list), userShards)
+	}
+
+	clients := make(map[string]pb.UserServiceClient, len(list))
+	for i, addr := range list {
+		conn, err := grpc.NewClient(strings.TrimSpace(addr), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error in dial user shard %s: %v", userShards[i], err)
+		}
+		clients[userShards[i]] = pb.NewUserServiceClient(conn)
+	}
+
+	return clients, nil
+}
+
+// userClientFor returns the user service of the shard which owns the user
+func userClientFor(userId string) pb.UserServiceClient {
+	return userServiceClients[transaction.ShardFor("user", userId)]
+}
+
+// listUserShards merges a page of every shard in the id order. A user is
+// only listed when no shard with more users can have a smaller id, so the
+// last id of the page is the token of the next one on every shard.
+func listUserShards(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	resp := &pb.ListUsersResponse{}
+	more, cutoff := false, ""
+	for _, shard := range userShards {
+		page, err := userServiceClients[shard].ListUsers(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Users = append(resp.Users, page.Users...)
+		if page.NextPageToken != "" && len(page.Users) > 0 {
+			if last := page.Users[len(page.Users)-1].Id; !more || last < cutoff {
+				cutoff = last
+			}
+			more = true
+		}
+	}
+
+	sort.Slice(resp.Users, func(i, j int) bool { return resp.Users[i].Id < resp.Users[j].Id })
+	if more {
+		n := sort.Search(len(resp.Users), func(i int) bool { return resp.Users[i].Id > cutoff })
+		resp.Users = resp.Users[:n]
+	}
+	if req.PageSize > 0 && len(resp.Users) > int(req.PageSize) {
+		resp.Users = resp.Users[:req.PageSize]
+		more = true
+	}
+	if more && len(resp.Users) > 0 {
+		resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(resp.Users[len(resp.Users)-1].Id))
+	}
+
+	return resp, nil
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	switch status.Code(err) {
+	case codes.NotFound:
+		rest.WriteError(w, http.StatusNotFound, status.Convert(err).Message())
+	case codes.AlreadyExists:
+		rest.WriteError(w, http.StatusConflict, status.Convert(err).Message())
+	case codes.InvalidArgument:
+		rest.WriteError(w, http.StatusBadRequest, status.Convert(err).Message())
+	default:
+		rest.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/rest"
+)
+
+// TopUp credits the amount in the body to the user wallet
+func TopUp(w http.ResponseWriter, r *http.Request) {
+	var topUpReq *pb.TopUpRequest
+	if err := rest.ReadJSON(r, &topUpReq); err != nil {
+		rest.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	topUpReq.UserId = r.PathValue("id")
+	topUpReq.IdempotencyKey = r.Header.Get("Idempotency-Key")
+
+	resp, err := coordinatorServiceClient.TopUp(r.Context(), topUpReq)
+	if err != nil {
+		writeWalletError(w, err)
+		return
+	}
+
+	writeWalletResponse(w, resp)
+}
+
+// Transfer moves the amount in the body to the wallet of to_user_id
+func Transfer(w http.ResponseWriter, r *http.Request) {
+	var transferReq *pb.TransferRequest
+	if err := rest.ReadJSON(r, &transferReq); err != nil {
+		rest.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	transferReq.FromUserId = r.PathValue("id")
+	transferReq.IdempotencyKey = r.Header.Get("Idempotency-Key")
+
+	resp, err := coordinatorServiceClient.Transfer(r.Context(), transferReq)
+	if err != nil {
+		writeWalletError(w, err)
+		return
+	}
+
+	writeWalletResponse(w, resp)
+}
+
+func writeWalletResponse(w http.ResponseWriter, resp *pb.WalletResponse) {
+	if !resp.Success {
+		writeAbort(w, resp.ReasonCode, resp.Message, resp.TransactionId)
+		return
+	}
+
+	rest.WriteJSON(w, http.StatusOK, map[string]string{
+		"message":        resp.Message,
+		"status":         "success",
+		"transaction_id": resp.TransactionId,
+	})
+}
+
+func writeWalletError(w http.ResponseWriter, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		rest.WriteError(w, http.StatusBadRequest, status.Convert(err).Message())
+	case codes.FailedPrecondition:
+		rest.WriteError(w, http.StatusConflict, status.Convert(err).Message())
+	default:
+		rest.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+	_ "github.com/lib/pq"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type grpcHandler struct {
+	pb.UnimplementedInventoryServiceServer
+
+	db *sql.DB
+}
+
+type transactionHandler struct {
+	serviceName string
+	db          *sql.DB
+	client      *zkclient.ZooKeeperClient
+	watcher     transaction.TransactionWatcher
+}
+
+func NewHandler(server *grpc.Server, watcher transaction.TransactionWatcher, zkClient *zkclient.ZooKeeperClient) {
+	log.Println("create inventory handler")
+
+	log.Println("connect db")
+	db, err := sql.Open("postgres", "host=inventory-db port=5432 user=postgres password=sample_password dbname=inventory sslmode=disable")
+	if err != nil {
+		log.Fatalf("connect db error: %v", err)
+	}
+	db.SetMaxIdleConns(5)
+	db.SetMaxOpenConns(10)
+	db.SetConnMaxLifetime(time.Minute * 5)
+
+	log.Println("ping db")
+	if err := db.Ping(); err != nil {
+		log.Fatalf("ping db error: %v", err)
+	}
+
+	log.Println("create table")
+	query := `
+		CREATE TABLE IF NOT EXISTS "stock" (
+			sku VARCHAR(1024) PRIMARY KEY,
+			quantity INT CHECK (quantity >= 0)
+		);
+	`
+	_, err = db.Exec(query)
+	if err != nil {
+		log.Printf("table created failed: %v\n", err)
+	}
+
+	if err = seedData(db); err != nil {
+		log.Printf("insert stock failed: %v\n", err)
+	}
+
+	log.Println("register grpc handler")
+	handler := &grpcHandler{db: db}
+	pb.RegisterInventoryServiceServer(server, handler)
+
+	registerTransactionHandlers(db, watcher, zkClient)
+}
+
+func seedData(db *sql.DB) error {
+	log.Println("seed stock")
+	stocks := []Stock{
+		{Sku: "apple", Quantity: 100},
+		{Sku: "pear", Quantity: 100},
+		{Sku: "banana", Quantity: 10},
+	}
+
+	for _, stock := range stocks {
+		query := "INSERT INTO stock (sku, quantity) VALUES ($1, $2) ON CONFLICT (sku) DO NOTHING"
+		if _, err := db.Exec(query, stock.Sku, stock.Quantity); err != nil {
+			return fmt.Errorf("insert stock %s failed: %v", stock.Sku, err)
+		}
+	}
+
+	return nil
+}
+
+func registerTransactionHandlers(db *sql.DB, watcher transaction.TransactionWatcher, client *zkclient.ZooKeeperClient) {
+	log.Println("register transaction handler")
+	txHandler := &transactionHandler{
+		serviceName: "inventory",
+		db:          db,
+		client:      client,
+		watcher:     watcher,
+	}
+
+	watcher.RegisterHandler(transaction.OrderCreation, txHandler.prepareReserveStock, txHandler.finalizeReserveStock)
+	watcher.RegisterHandler(transaction.OrderCancellation, txHandler.prepareRestock, txHandler.finalizeRestock)
+
+	watcher.Watch()
+}
+
+func (h *transactionHandler) prepareReserveStock(txData transaction.TransactionData) error {
+	log.Println("inventory service: 2pc reserve stock")
+
+	// Ensure the transaction is prepared and every participant entered phase 1
+	path := h.watcher.GetBasePath() + "/" + string(transaction.OrderCreation) + "/" + txData.Id + "/" + h.serviceName
+	prepared, err := h.watcher.EnterPrepare(txData, h.serviceName)
+	if err != nil {
+		return err
+	}
+	if !prepared {
+		log.Printf("skip reserve stock transaction %s\n", txData.Id)
+		return nil
+	}
+	defer h.watcher.LeavePrepare(txData, h.serviceName)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in start transaction: %v", err)
+	}
+	defer tx.Commit()
+
+	var data *pb.PlaceOrderRequest
+	if err := json.Unmarshal(txData.Payload, &data); err != nil {
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in unmarshal payload: %v", err)
+	}
+
+	// lock the rows in the same order in every transaction to avoid deadlocks
+	items := append([]*pb.LineItem{}, data.Items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].Sku < items[j].Sku })
+
+	for _, item := range items {
+		var stock Stock
+		row := tx.QueryRow("SELECT sku, quantity FROM stock WHERE sku = $1 FOR UPDATE", item.Sku)
+		if err := row.Scan(&stock.Sku, &stock.Quantity); err != nil {
+			if err == sql.ErrNoRows {
+				h.rollback(tx, txData, transaction.AbortReason{
+					Code:    transaction.ReasonUnknownSku,
+					Message: fmt.Sprintf("sku %s not found", item.Sku),
+				})
+				return fmt.Errorf("sku %s not found", item.Sku)
+			}
+			h.rollback(tx, txData, internalReason(err))
+			return err
+		}
+
+		if stock.Quantity < int(item.Quantity) {
+			h.rollback(tx, txData, transaction.AbortReason{
+				Code:    transaction.ReasonOutOfStock,
+				Message: fmt.Sprintf("sku %s out of stock, %d is available", item.Sku, stock.Quantity),
+			})
+			return fmt.Errorf("error sku %s out of stock", item.Sku)
+		}
+
+		query := `
+			UPDATE stock
+			SET quantity = quantity - $1
+			WHERE sku = $2
+		`
+		if _, err := tx.Exec(query, item.Quantity, item.Sku); err != nil {
+			h.rollback(tx, txData, internalReason(err))
+			return err
+		}
+	}
+
+	query := fmt.Sprintf("PREPARE TRANSACTION '%s'", txData.Id)
+	_, err = tx.Exec(query)
+	if err != nil {
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in execute prepare statement: %v", err)
+	}
+
+	log.Println("write znode value")
+	err = h.client.Set(path, []byte(transaction.StatusReady))
+	if err != nil {
+		log.Printf("error in write in zookeeper: %v\n", err)
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in write in zookeeper: %v", err)
+	}
+
+	log.Println("inventory service ready")
+
+	return nil
+}
+
+// prepareRestock puts the items of a cancelled order back into the stock
+func (h *transactionHandler) prepareRestock(txData transaction.TransactionData) error {
+	log.Println("inventory service: 2pc restock")
+
+	path := h.watcher.GetBasePath() + "/" + string(transaction.OrderCancellation) + "/" + txData.Id + "/" + h.serviceName
+	prepared, err := h.watcher.EnterPrepare(txData, h.serviceName)
+	if err != nil {
+		return err
+	}
+	if !prepared {
+		log.Printf("skip restock transaction %s\n", txData.Id)
+		return nil
+	}
+	defer h.watcher.LeavePrepare(txData, h.serviceName)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in start transaction: %v", err)
+	}
+	defer tx.Commit()
+
+	var data *pb.OrderRefund
+	if err := json.Unmarshal(txData.Payload, &data); err != nil {
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in unmarshal payload: %v", err)
+	}
+
+	// lock the rows in the same order in every transaction to avoid deadlocks,
+	// a sku removed since the order was placed is added again
+	items := append([]*pb.LineItem{}, data.Items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].Sku < items[j].Sku })
+
+	for _, item := range items {
+		query := `
+			INSERT INTO stock (sku, quantity) VALUES ($1, $2)
+			ON CONFLICT (sku) DO UPDATE SET quantity = stock.quantity + EXCLUDED.quantity
+		`
+		if _, err := tx.Exec(query, item.Sku, item.Quantity); err != nil {
+			h.rollback(tx, txData, internalReason(err))
+			return err
+		}
+	}
+
+	query := fmt.Sprintf("PREPARE TRANSACTION '%s'", txData.Id)
+	_, err = tx.Exec(query)
+	if err != nil {
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in execute prepare statement: %v", err)
+	}
+
+	log.Println("write znode value")
+	err = h.client.Set(path, []byte(transaction.StatusReady))
+	if err != nil {
+		log.Printf("error in write in zookeeper: %v\n", err)
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in write in zookeeper: %v", err)
+	}
+
+	log.Println("inventory service ready")
+
+	return nil
+}
+
+func (h *transactionHandler) finalizeReserveStock(txId string) error {
+	return h.finalize(transaction.OrderCreation, txId)
+}
+
+func (h *transactionHandler) finalizeRestock(txId string) error {
+	return h.finalize(transaction.OrderCancellation, txId)
+}
+
+// finalize applies the decision to the prepared transaction
+func (h *transactionHandler) finalize(txType transaction.TransactionType, txId string) error {
+	if err := h.watcher.WaitDecision(txId); err != nil {
+		return err
+	}
+
+	path := h.watcher.GetBasePath() + "/" + string(txType) + "/" + txId + "/" + h.serviceName
+	for {
+		data, ch, err := h.client.GetW(path) // watches transaction znode value
+		if err != nil {
+			return fmt.Errorf("error in set %s watches: %v", path, err)
+		}
+
+		switch string(data) {
+		case string(transaction.StatusCommit):
+			for {
+				log.Printf("Commit %s transaction %s\n", txType, txId)
+				query := fmt.Sprintf("COMMIT PREPARED '%s'", txId)
+				_, err := h.db.Exec(query)
+				if err != nil {
+					if err == sql.ErrTxDone {
+						break
+					}
+					log.Printf("error in commit prepared transaction %s: %v\n", txId, err)
+					time.Sleep(time.Second)
+					continue
+				}
+				break
+			}
+			for {
+				err = h.client.Set(path, []byte(transaction.StatusCommitted))
+				if err != nil {
+					log.Printf("error in set znode value: %v\n", err)
+					time.Sleep(time.Second)
+					continue
+				}
+				break
+			}
+			return nil
+		case string(transaction.StatusRollBack):
+			for {
+				log.Printf("Rollback %s transaction %s\n", txType, txId)
+				query := fmt.Sprintf("ROLLBACK PREPARED '%s'", txId)
+				_, err := h.db.Exec(query)
+				if err != nil {
+					if err == sql.ErrTxDone {
+						break
+					}
+					log.Printf("error in rollback prepared transaction %s: %v\n", txId, err)
+					time.Sleep(time.Second)
+					continue
+				}
+				break
+			}
+			for {
+				err = h.client.Set(path, []byte(transaction.StatusRolledBack))
+				if err != nil {
+					log.Printf("error in set znode value: %v\n", err)
+					time.Sleep(time.Second)
+					continue
+				}
+				break
+			}
+			return nil
+		case string(transaction.StatusCommitted):
+			return nil
+		case string(transaction.StatusRolledBack):
+			return nil
+		default:
+			log.Printf("finalize %s transaction data: %v\n", txType, string(data))
+		}
+
+		<-ch
+	}
+}
+
+// rollback votes abort with the reason shown to the client
+func (h *transactionHandler) rollback(tx *sql.Tx, txData transaction.TransactionData, reason transaction.AbortReason) error {
+	if tx != nil {
+		tx.Rollback()
+	}
+
+	return h.watcher.VoteAbort(txData, h.serviceName, reason)
+}
+
+func internalReason(err error) transaction.AbortReason {
+	return transaction.AbortReason{Code: transaction.ReasonInternal, Message: err.Error()}
+}
+
+func (h *grpcHandler) GetStock(ctx context.Context, req *pb.GetStockRequest) (*pb.Stock, error) {
+	log.Println("inventory service: get stock")
+
+	var resp pb.Stock
+	row := h.db.QueryRow("SELECT sku, quantity FROM stock WHERE sku = $1", req.Sku)
+	if err := row.Scan(&resp.Sku, &resp.Quantity); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "sku %s not found", req.Sku)
+		}
+		return nil, fmt.Errorf("sku %s: %v", req.Sku, err)
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	host, ok := syscall.Getenv("HOST")
+	if !ok {
+		host = "127.0.0.1"
+	}
+
+	listen, err := net.Listen("tcp", fmt.Sprintf("%s:8083", host))
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	defer listen.Close()
+
+	zkConfig, err := zkclient.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	zkClient, err := zkclient.NewZooKeeperClient(zkConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("new transaction watcher")
+	txWatcher, err := transaction.NewTransactionWatcher(zkClient, "inventory")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	NewHandler(server, txWatcher, zkClient)
+
+	log.Printf("Inventory service started at %s:8083\n", host)
+
+	if err := server.Serve(listen); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,6 @@
+package main
+
+type Stock struct {
+	Sku      string
+	Quantity int
+}
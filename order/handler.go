@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -9,12 +8,12 @@ import (
 	"time"
 
 	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 	"google.golang.org/grpc"
-	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type grpcHandler struct {
@@ -45,12 +44,32 @@ func NewHandler(server *grpc.Server, watcher transaction.TransactionWatcher, zkC
 		log.Fatalf("ping db error: %v", err)
 	}
 
+	// price is the order total in minor units of its currency, the items
+	// are priced in the same currency. Orders created before the status
+	// lifecycle were confirmed by their transaction, and the orders created
+	// before the currency were priced in USD.
 	query := `
 		CREATE TABLE IF NOT EXISTS "orders" (
 			id VARCHAR(1024) PRIMARY KEY,
 			user_id VARCHAR(1024),
-			price INT
+			price BIGINT
 		);
+		ALTER TABLE orders ALTER COLUMN price TYPE BIGINT;
+		ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+		ALTER TABLE orders ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'CONFIRMED';
+		ALTER TABLE orders ADD COLUMN IF NOT EXISTS transaction_id VARCHAR(1024);
+		ALTER TABLE orders ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		ALTER TABLE orders ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		CREATE INDEX IF NOT EXISTS orders_transaction_id ON orders (transaction_id);
+		CREATE INDEX IF NOT EXISTS orders_user_id ON orders (user_id, created_at, id);
+		CREATE TABLE IF NOT EXISTS "order_items" (
+			order_id VARCHAR(1024) REFERENCES orders (id),
+			sku VARCHAR(1024),
+			quantity INT,
+			unit_price BIGINT,
+			PRIMARY KEY (order_id, sku)
+		);
+		ALTER TABLE order_items ALTER COLUMN unit_price TYPE BIGINT;
 	`
 	_, err = db.Exec(query)
 	if err != nil {
@@ -72,6 +91,7 @@ func registerTransactionHandlers(db *sql.DB, watcher transaction.TransactionWatc
 	}
 
 	watcher.RegisterHandler(transaction.OrderCreation, txHandler.prepareCreateOrder, txHandler.finalizeCreateOrder)
+	watcher.RegisterHandler(transaction.OrderCancellation, txHandler.prepareCancelOrder, txHandler.finalizeCancelOrder)
 
 	watcher.Watch()
 }
@@ -79,30 +99,22 @@ func registerTransactionHandlers(db *sql.DB, watcher transaction.TransactionWatc
 func (h *transactionHandler) prepareCreateOrder(txData transaction.TransactionData) error {
 	log.Println("order service: 2pc create order")
 
-	// Ensure the transaction is prepared
+	// Ensure the transaction is prepared and every participant entered phase 1
 	path := h.watcher.GetBasePath() + "/" + string(transaction.OrderCreation) + "/" + txData.Id + "/" + h.serviceName
-	for {
-		data, ch, err := h.client.GetW(path)
-		if err != nil {
-			return fmt.Errorf("error in set %s watches: %v", path, err)
-		}
-		log.Printf("prepare create order status: %s\n", data)
-
-		if string(data) == string(transaction.StatusPrepared) {
-			break
-		}
-
-		if string(data) != string(transaction.StatusInit) {
-			return nil
-		}
-
-		<-ch
+	prepared, err := h.watcher.EnterPrepare(txData, h.serviceName)
+	if err != nil {
+		return err
+	}
+	if !prepared {
+		log.Printf("skip create order transaction %s\n", txData.Id)
+		return nil
 	}
+	defer h.watcher.LeavePrepare(txData, h.serviceName)
 
 	tx, err := h.db.Begin()
 	if err != nil {
 		log.Printf("error in begin transaction: %v\n", err)
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
+		h.rollback(tx, txData, internalReason(err))
 		return fmt.Errorf("error in begin transaction: %v", err)
 	}
 	defer tx.Commit()
@@ -115,19 +127,36 @@ func (h *transactionHandler) prepareCreateOrder(txData transaction.TransactionDa
 		return fmt.Errorf("error in unmarshal payload: %v", err)
 	}
 
-	query := `INSERT INTO orders (id, user_id, price) VALUES ($1, $2, $3)`
-	_, err = tx.Exec(query, id, data.UserId, data.Price)
+	if reason := checkTotal(data); reason != nil {
+		h.rollback(tx, txData, *reason)
+		return fmt.Errorf("error in create order: %s", reason.Message)
+	}
+
+	query := `
+		INSERT INTO orders (id, user_id, price, currency, status, transaction_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, now(), now())
+	`
+	_, err = tx.Exec(query, id, data.UserId, data.Price.Amount, data.Price.Currency, OrderPending, txData.Id)
 	if err != nil {
 		log.Printf("error in execute insert order: %v\n", err)
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
+		h.rollback(tx, txData, internalReason(err))
 		return err
 	}
 
+	query = `INSERT INTO order_items (order_id, sku, quantity, unit_price) VALUES ($1, $2, $3, $4)`
+	for _, item := range data.Items {
+		if _, err := tx.Exec(query, id, item.Sku, item.Quantity, item.UnitPrice.Amount); err != nil {
+			log.Printf("error in execute insert order item: %v\n", err)
+			h.rollback(tx, txData, internalReason(err))
+			return err
+		}
+	}
+
 	query = fmt.Sprintf("PREPARE TRANSACTION '%s'", txData.Id)
 	_, err = tx.Exec(query)
 	if err != nil {
 		log.Printf("error in execute prepare statement: %v\n", err)
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
+		h.rollback(tx, txData, internalReason(err))
 		return fmt.Errorf("error in execute prepare statement: %v", err)
 	}
 
@@ -135,7 +164,113 @@ func (h *transactionHandler) prepareCreateOrder(txData transaction.TransactionDa
 	err = h.client.Set(path, []byte(transaction.StatusReady))
 	if err != nil {
 		log.Printf("error in write in zookeeper: %v\n", err)
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in write in zookeeper: %v", err)
+	}
+
+	log.Println("order service ready")
+
+	return nil
+}
+
+// prepareCancelOrder cancels a confirmed order of the refunded user, the
+// refund must be the order total
+func (h *transactionHandler) prepareCancelOrder(txData transaction.TransactionData) error {
+	log.Println("order service: 2pc cancel order")
+
+	path := h.watcher.GetBasePath() + "/" + string(transaction.OrderCancellation) + "/" + txData.Id + "/" + h.serviceName
+	prepared, err := h.watcher.EnterPrepare(txData, h.serviceName)
+	if err != nil {
+		return err
+	}
+	if !prepared {
+		log.Printf("skip cancel order transaction %s\n", txData.Id)
+		return nil
+	}
+	defer h.watcher.LeavePrepare(txData, h.serviceName)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("error in begin transaction: %v\n", err)
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in begin transaction: %v", err)
+	}
+	defer tx.Commit()
+
+	var data *pb.OrderRefund
+	if err := json.Unmarshal(txData.Payload, &data); err != nil {
+		log.Printf("error in unmarshal payload: %v\n", err)
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in unmarshal payload: %v", err)
+	}
+
+	var userId string
+	var price pb.Money
+	var orderStatus OrderStatus
+	row := tx.QueryRow("SELECT user_id, price, currency, status FROM orders WHERE id = $1 FOR UPDATE", data.OrderId)
+	if err := row.Scan(&userId, &price.Amount, &price.Currency, &orderStatus); err != nil {
+		if err == sql.ErrNoRows {
+			h.rollback(tx, txData, transaction.AbortReason{
+				Code:    transaction.ReasonOrderNotFound,
+				Message: fmt.Sprintf("order id %s not found", data.OrderId),
+			})
+			return fmt.Errorf("order id %s not found", data.OrderId)
+		}
+		h.rollback(tx, txData, internalReason(err))
+		return err
+	}
+
+	var reason *transaction.AbortReason
+	switch {
+	case userId != data.UserId:
+		reason = &transaction.AbortReason{
+			Code:    transaction.ReasonOrderNotOwned,
+			Message: fmt.Sprintf("order %s does not belong to user %s", data.OrderId, data.UserId),
+		}
+	case orderStatus == OrderCancelled:
+		reason = &transaction.AbortReason{
+			Code:    transaction.ReasonOrderCancelled,
+			Message: fmt.Sprintf("order %s is already cancelled", data.OrderId),
+		}
+	case orderStatus != OrderConfirmed:
+		reason = &transaction.AbortReason{
+			Code:    transaction.ReasonOrderNotConfirmed,
+			Message: fmt.Sprintf("order %s is %s", data.OrderId, orderStatus),
+		}
+	case price.Currency != data.Amount.GetCurrency():
+		reason = &transaction.AbortReason{
+			Code:    transaction.ReasonCurrencyMismatch,
+			Message: fmt.Sprintf("refund in %s of an order in %s", data.Amount.GetCurrency(), price.Currency),
+		}
+	case !money.Equal(&price, data.Amount):
+		reason = &transaction.AbortReason{
+			Code:    transaction.ReasonInternal,
+			Message: fmt.Sprintf("refund %s does not match the order total %s", money.String(data.Amount), money.String(&price)),
+		}
+	}
+	if reason != nil {
+		h.rollback(tx, txData, *reason)
+		return fmt.Errorf("error in cancel order %s: %s", data.OrderId, reason.Message)
+	}
+
+	query := `UPDATE orders SET status = $1, updated_at = now() WHERE id = $2`
+	if _, err := tx.Exec(query, OrderCancelled, data.OrderId); err != nil {
+		log.Printf("error in execute cancel order: %v\n", err)
+		h.rollback(tx, txData, internalReason(err))
+		return err
+	}
+
+	query = fmt.Sprintf("PREPARE TRANSACTION '%s'", txData.Id)
+	if _, err := tx.Exec(query); err != nil {
+		log.Printf("error in execute prepare statement: %v\n", err)
+		h.rollback(tx, txData, internalReason(err))
+		return fmt.Errorf("error in execute prepare statement: %v", err)
+	}
+
+	log.Println("write znode value")
+	if err := h.client.Set(path, []byte(transaction.StatusReady)); err != nil {
+		log.Printf("error in write in zookeeper: %v\n", err)
+		h.rollback(tx, txData, internalReason(err))
 		return fmt.Errorf("error in write in zookeeper: %v", err)
 	}
 
@@ -145,8 +280,24 @@ func (h *transactionHandler) prepareCreateOrder(txData transaction.TransactionDa
 }
 
 func (h *transactionHandler) finalizeCreateOrder(txId string) error {
-	log.Println("Finalize create order transaction")
-	path := h.watcher.GetBasePath() + "/" + string(transaction.OrderCreation) + "/" + txId + "/" + h.serviceName
+	return h.finalize(transaction.OrderCreation, txId, func() error {
+		return h.setOrderStatus(txId, OrderConfirmed)
+	})
+}
+
+func (h *transactionHandler) finalizeCancelOrder(txId string) error {
+	return h.finalize(transaction.OrderCancellation, txId, nil)
+}
+
+// finalize applies the decision to the prepared transaction, committed runs
+// once the transaction has been committed
+func (h *transactionHandler) finalize(txType transaction.TransactionType, txId string, committed func() error) error {
+	log.Printf("Finalize %s transaction %s\n", txType, txId)
+	if err := h.watcher.WaitDecision(txId); err != nil {
+		return err
+	}
+
+	path := h.watcher.GetBasePath() + "/" + string(txType) + "/" + txId + "/" + h.serviceName
 	for {
 		data, ch, err := h.client.GetW(path) // watches transaction znode value
 		if err != nil {
@@ -157,7 +308,7 @@ func (h *transactionHandler) finalizeCreateOrder(txId string) error {
 		switch string(data) {
 		case string(transaction.StatusCommit):
 			for {
-				log.Println("Commit create order transaction")
+				log.Printf("Commit %s transaction %s\n", txType, txId)
 				query := fmt.Sprintf("COMMIT PREPARED '%s'", txId)
 				_, err := h.db.Exec(query)
 				if err != nil {
@@ -170,6 +321,14 @@ func (h *transactionHandler) finalizeCreateOrder(txId string) error {
 				}
 				break
 			}
+			for committed != nil {
+				if err := committed(); err != nil {
+					log.Println(err)
+					time.Sleep(time.Second)
+					continue
+				}
+				break
+			}
 			for {
 				err = h.client.Set(path, []byte(transaction.StatusCommitted))
 				if err != nil {
@@ -182,7 +341,7 @@ func (h *transactionHandler) finalizeCreateOrder(txId string) error {
 			return nil
 		case string(transaction.StatusRollBack):
 			for {
-				log.Println("Rollback create order transaction")
+				log.Printf("Rollback %s transaction %s\n", txType, txId)
 				query := fmt.Sprintf("ROLLBACK PREPARED '%s'", txId)
 				_, err := h.db.Exec(query)
 				if err != nil {
@@ -210,44 +369,70 @@ func (h *transactionHandler) finalizeCreateOrder(txId string) error {
 		case string(transaction.StatusRolledBack):
 			return nil
 		default:
-			log.Printf("finalize create order transaction data: %v\n", string(data))
+			log.Printf("finalize %s transaction data: %v\n", txType, string(data))
 		}
 
 		<-ch
 	}
 }
 
-func (h *transactionHandler) rollback(tx *sql.Tx, txId string, txType transaction.TransactionType) error {
-	path := h.watcher.GetBasePath() + "/" + string(txType) + "/" + txId + "/" + h.serviceName
-	tx.Rollback()
-	err := h.client.Set(path, []byte(transaction.StatusAbort))
-	if err != nil {
-		return err
+// setOrderStatus moves the order created by a transaction to a new status
+func (h *transactionHandler) setOrderStatus(txId string, status OrderStatus) error {
+	query := `UPDATE orders SET status = $1, updated_at = now() WHERE transaction_id = $2`
+	if _, err := h.db.Exec(query, status, txId); err != nil {
+		return fmt.Errorf("error in set order status of transaction %s: %v", txId, err)
 	}
 
 	return nil
 }
 
-func (h *grpcHandler) GetOrders(ctx context.Context, req *emptypb.Empty) (*pb.GetOrdersResponse, error) {
-	log.Println("order service: get orders")
+// checkTotal prices the items again, they must be in the currency of the
+// order and add up to its total
+func checkTotal(data *pb.PlaceOrderRequest) *transaction.AbortReason {
+	if err := money.Validate(data.Price); err != nil {
+		return &transaction.AbortReason{Code: transaction.ReasonInternal, Message: err.Error()}
+	}
+	if len(data.Items) == 0 {
+		return nil
+	}
 
-	rows, err := h.db.Query("SELECT id, price FROM orders")
-	if err != nil {
-		log.Printf("error in query orders: %v\n", err)
-		return nil, err
+	total := money.New(0, data.Price.Currency)
+	for _, item := range data.Items {
+		if item.UnitPrice.GetCurrency() != data.Price.Currency {
+			return &transaction.AbortReason{
+				Code:    transaction.ReasonCurrencyMismatch,
+				Message: fmt.Sprintf("item %s is priced in %s, the order in %s", item.Sku, item.UnitPrice.GetCurrency(), data.Price.Currency),
+			}
+		}
+
+		subtotal, err := money.Mul(item.UnitPrice, int64(item.Quantity))
+		if err == nil {
+			total, err = money.Add(total, subtotal)
+		}
+		if err != nil {
+			return &transaction.AbortReason{Code: transaction.ReasonAmountOverflow, Message: err.Error()}
+		}
 	}
-	defer rows.Close()
 
-	var orders []*pb.Order
-	for rows.Next() {
-		var order pb.Order
-		if err := rows.Scan(&order.Id, &order.Price); err != nil {
-			log.Printf("error in scan order: %v\n", err)
-			return nil, err
+	if !money.Equal(total, data.Price) {
+		return &transaction.AbortReason{
+			Code:    transaction.ReasonInternal,
+			Message: fmt.Sprintf("price %s does not match the items total %s", money.String(data.Price), money.String(total)),
 		}
+	}
+
+	return nil
+}
 
-		orders = append(orders, &order)
+// rollback votes abort with the reason shown to the client
+func (h *transactionHandler) rollback(tx *sql.Tx, txData transaction.TransactionData, reason transaction.AbortReason) error {
+	if tx != nil {
+		tx.Rollback()
 	}
 
-	return &pb.GetOrdersResponse{Orders: orders}, nil
+	return h.watcher.VoteAbort(txData, h.serviceName, reason)
+}
+
+func internalReason(err error) transaction.AbortReason {
+	return transaction.AbortReason{Code: transaction.ReasonInternal, Message: err.Error()}
 }
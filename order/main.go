@@ -23,17 +23,17 @@ func main() {
 	}
 	defer listen.Close()
 
-	zkServer, ok := syscall.Getenv("ZK_SERVER")
-	if !ok {
-		zkServer = "localhost:2181"
+	zkConfig, err := zkclient.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	zkClient, err := zkclient.NewZooKeeperClient([]string{zkServer})
+	zkClient, err := zkclient.NewZooKeeperClient(zkConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	txWatcher, err := transaction.NewTransactionWatcher(zkClient)
+	txWatcher, err := transaction.NewTransactionWatcher(zkClient, "order")
 	if err != nil {
 		log.Fatal(err)
 	}
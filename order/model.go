@@ -0,0 +1,9 @@
+package main
+
+type OrderStatus string
+
+const (
+	OrderPending   OrderStatus = "PENDING"
+	OrderConfirmed OrderStatus = "CONFIRMED"
+	OrderCancelled OrderStatus = "CANCELLED"
+)
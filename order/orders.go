@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+const orderColumns = "id, user_id, price, currency, status, COALESCE(transaction_id, ''), created_at, updated_at"
+
+// the columns the orders can be sorted by
+var sortColumns = map[string]string{
+	"":           "created_at",
+	"created_at": "created_at",
+	"total":      "price",
+}
+
+// pageCursor is the sort key of the last order of a page
+type pageCursor struct {
+	SortBy     string    `json:"sort_by"`
+	Descending bool      `json:"descending"`
+	CreatedAt  time.Time `json:"created_at,omitempty"`
+	Total      int64     `json:"total,omitempty"`
+	Id         string    `json:"id"`
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanOrder(row rowScanner) (*pb.Order, error) {
+	order := pb.Order{Total: &pb.Money{}}
+	var createdAt, updatedAt time.Time
+	err := row.Scan(&order.Id, &order.UserId, &order.Total.Amount, &order.Total.Currency,
+		&order.Status, &order.TransactionId, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	order.CreatedAt = timestamppb.New(createdAt)
+	order.UpdatedAt = timestamppb.New(updatedAt)
+
+	return &order, nil
+}
+
+func (h *grpcHandler) GetOrders(ctx context.Context, req *emptypb.Empty) (*pb.GetOrdersResponse, error) {
+	log.Println("order service: get orders")
+
+	orders, err := h.queryOrders(ctx, "SELECT "+orderColumns+" FROM orders ORDER BY created_at, id")
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	return &pb.GetOrdersResponse{Orders: orders}, nil
+}
+
+func (h *grpcHandler) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*pb.Order, error) {
+	log.Println("order service: get order")
+
+	row := h.db.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = $1", req.Id)
+	order, err := scanOrder(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "order id %s not found", req.Id)
+		}
+		return nil, fmt.Errorf("order id %s: %v", req.Id, err)
+	}
+
+	if err := h.loadItems(ctx, []*pb.Order{order}); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func (h *grpcHandler) ListOrders(ctx context.Context, req *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	log.Println("order service: list orders")
+
+	column, ok := sortColumns[req.SortBy]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sort %s", req.SortBy)
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	pageSize = min(pageSize, maxPageSize)
+
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if req.UserId != "" {
+		where("user_id = $%d", req.UserId)
+	}
+	if req.Status != "" {
+		where("status = $%d", req.Status)
+	}
+	if req.CreatedAfter != nil {
+		where("created_at >= $%d", req.CreatedAfter.AsTime())
+	}
+	if req.CreatedBefore != nil {
+		where("created_at < $%d", req.CreatedBefore.AsTime())
+	}
+	if req.Currency != "" {
+		where("currency = $%d", req.Currency)
+	}
+	if req.TransactionId != "" {
+		where("transaction_id = $%d", req.TransactionId)
+	}
+	if req.MinTotal != nil {
+		where("price >= $%d", req.GetMinTotal())
+	}
+	if req.MaxTotal != nil {
+		where("price <= $%d", req.GetMaxTotal())
+	}
+
+	// the page starts after the cursor in the sort order, the id breaks ties
+	direction, compare := "ASC", ">"
+	if req.Descending {
+		direction, compare = "DESC", "<"
+	}
+	if req.PageToken != "" {
+		cursor, err := decodeCursor(req.PageToken)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token: %v", err)
+		}
+		if sortColumns[cursor.SortBy] != column || cursor.Descending != req.Descending {
+			return nil, status.Error(codes.InvalidArgument, "page token of another sort")
+		}
+
+		var value any = cursor.CreatedAt
+		if column == "price" {
+			value = cursor.Total
+		}
+		args = append(args, value, cursor.Id)
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d, $%d)", column, compare, len(args)-1, len(args)))
+	}
+
+	query := "SELECT " + orderColumns + " FROM orders"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, pageSize+1)
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", column, direction, direction, len(args))
+
+	orders, err := h.queryOrders(ctx, query, args...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	// one more order tells whether there is a next page
+	resp := &pb.ListOrdersResponse{Orders: orders}
+	if len(orders) > pageSize {
+		resp.Orders = orders[:pageSize]
+		last := resp.Orders[pageSize-1]
+		resp.NextPageToken = encodeCursor(pageCursor{
+			SortBy:     req.SortBy,
+			Descending: req.Descending,
+			CreatedAt:  last.CreatedAt.AsTime(),
+			Total:      last.Total.GetAmount(),
+			Id:         last.Id,
+		})
+	}
+
+	return resp, nil
+}
+
+// queryOrders returns the orders of the query with their items
+func (h *grpcHandler) queryOrders(ctx context.Context, query string, args ...any) ([]*pb.Order, error) {
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error in query orders: %v", err)
+	}
+	defer rows.Close()
+
+	var orders []*pb.Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error in scan order: %v", err)
+		}
+
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error in query orders: %v", err)
+	}
+
+	if err := h.loadItems(ctx, orders); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// loadItems fills in the line items of the orders
+func (h *grpcHandler) loadItems(ctx context.Context, orders []*pb.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	index := make(map[string]*pb.Order, len(orders))
+	ids := make([]string, 0, len(orders))
+	for _, order := range orders {
+		index[order.Id] = order
+		ids = append(ids, order.Id)
+	}
+
+	query := `
+		SELECT order_id, sku, quantity, unit_price
+		FROM order_items
+		WHERE order_id = ANY($1)
+		ORDER BY order_id, sku
+	`
+	rows, err := h.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("error in query order items: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderId string
+		item := pb.LineItem{UnitPrice: &pb.Money{}}
+		if err := rows.Scan(&orderId, &item.Sku, &item.Quantity, &item.UnitPrice.Amount); err != nil {
+			return fmt.Errorf("error in scan order item: %v", err)
+		}
+
+		// the items are priced in the currency of the order
+		if order, ok := index[orderId]; ok {
+			item.UnitPrice.Currency = order.Total.GetCurrency()
+			order.Items = append(order.Items, &item)
+		}
+	}
+
+	return rows.Err()
+}
+
+func encodeCursor(cursor pageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string) (pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return pageCursor{}, err
+	}
+
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return pageCursor{}, err
+	}
+	if cursor.Id == "" {
+		return pageCursor{}, fmt.Errorf("missing order id")
+	}
+
+	return cursor, nil
+}
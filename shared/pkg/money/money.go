@@ -0,0 +1,88 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+)
+
+// DefaultCurrency is the currency of amounts given without one, and of the
+// wallets and orders stored before amounts had a currency
+const DefaultCurrency = "USD"
+
+var (
+	ErrOverflow         = errors.New("amount overflows 64 bits")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+)
+
+func New(amount int64, currency string) *pb.Money {
+	return &pb.Money{Amount: amount, Currency: currency}
+}
+
+// Normalize fills the default currency in, a nil amount is zero
+func Normalize(m *pb.Money) *pb.Money {
+	if m == nil {
+		return New(0, DefaultCurrency)
+	}
+	if m.Currency == "" {
+		return New(m.Amount, DefaultCurrency)
+	}
+
+	return m
+}
+
+// Validate checks the currency is an ISO 4217 code and the amount is not
+// negative
+func Validate(m *pb.Money) error {
+	if len(m.GetCurrency()) != 3 {
+		return fmt.Errorf("invalid currency %q", m.GetCurrency())
+	}
+	for _, c := range m.GetCurrency() {
+		if c < 'A' || c > 'Z' {
+			return fmt.Errorf("invalid currency %q", m.GetCurrency())
+		}
+	}
+	if m.GetAmount() < 0 {
+		return fmt.Errorf("amount %d must not be negative", m.GetAmount())
+	}
+
+	return nil
+}
+
+// Add sums two amounts of the same currency
+func Add(a, b *pb.Money) (*pb.Money, error) {
+	if a.GetCurrency() != b.GetCurrency() {
+		return nil, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, a.GetCurrency(), b.GetCurrency())
+	}
+
+	x, y := a.GetAmount(), b.GetAmount()
+	if (y > 0 && x > math.MaxInt64-y) || (y < 0 && x < math.MinInt64-y) {
+		return nil, fmt.Errorf("%w: %d + %d", ErrOverflow, x, y)
+	}
+
+	return New(x+y, a.GetCurrency()), nil
+}
+
+// Mul multiplies the amount by n, e.g. the unit price by the quantity
+func Mul(m *pb.Money, n int64) (*pb.Money, error) {
+	x := m.GetAmount()
+	if x != 0 && n != 0 {
+		r := x * n
+		if r/n != x || (x == -1 && n == math.MinInt64) || (n == -1 && x == math.MinInt64) {
+			return nil, fmt.Errorf("%w: %d * %d", ErrOverflow, x, n)
+		}
+	}
+
+	return New(x*n, m.GetCurrency()), nil
+}
+
+// Equal compares the amount and the currency
+func Equal(a, b *pb.Money) bool {
+	return a.GetAmount() == b.GetAmount() && a.GetCurrency() == b.GetCurrency()
+}
+
+func String(m *pb.Money) string {
+	return fmt.Sprintf("%d %s", m.GetAmount(), m.GetCurrency())
+}
@@ -0,0 +1,134 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+)
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *pb.Money
+		want *pb.Money
+		err  error
+	}{
+		{name: "sum", a: New(150, "USD"), b: New(250, "USD"), want: New(400, "USD")},
+		{name: "negative", a: New(100, "USD"), b: New(-250, "USD"), want: New(-150, "USD")},
+		{name: "max", a: New(math.MaxInt64-1, "USD"), b: New(1, "USD"), want: New(math.MaxInt64, "USD")},
+		{name: "min", a: New(math.MinInt64+1, "USD"), b: New(-1, "USD"), want: New(math.MinInt64, "USD")},
+		{name: "max and min", a: New(math.MaxInt64, "USD"), b: New(math.MinInt64, "USD"), want: New(-1, "USD")},
+		{name: "over max", a: New(math.MaxInt64, "USD"), b: New(1, "USD"), err: ErrOverflow},
+		{name: "under min", a: New(math.MinInt64, "USD"), b: New(-1, "USD"), err: ErrOverflow},
+		{name: "max twice", a: New(math.MaxInt64, "USD"), b: New(math.MaxInt64, "USD"), err: ErrOverflow},
+		{name: "min twice", a: New(math.MinInt64, "USD"), b: New(math.MinInt64, "USD"), err: ErrOverflow},
+		{name: "currency mismatch", a: New(1, "USD"), b: New(1, "EUR"), err: ErrCurrencyMismatch},
+		{name: "missing currency", a: New(1, "USD"), b: New(1, ""), err: ErrCurrencyMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Add(tt.a, tt.b)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Add(%s, %s) error = %v, want %v", String(tt.a), String(tt.b), err, tt.err)
+			}
+			if tt.err == nil && !Equal(got, tt.want) {
+				t.Errorf("Add(%s, %s) = %s, want %s", String(tt.a), String(tt.b), String(got), String(tt.want))
+			}
+		})
+	}
+}
+
+func TestMul(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *pb.Money
+		n    int64
+		want *pb.Money
+		err  error
+	}{
+		{name: "quantity", m: New(250, "EUR"), n: 3, want: New(750, "EUR")},
+		{name: "zero quantity", m: New(math.MaxInt64, "EUR"), n: 0, want: New(0, "EUR")},
+		{name: "zero amount", m: New(0, "EUR"), n: math.MinInt64, want: New(0, "EUR")},
+		{name: "max", m: New(math.MaxInt64, "EUR"), n: 1, want: New(math.MaxInt64, "EUR")},
+		{name: "min", m: New(math.MinInt64, "EUR"), n: 1, want: New(math.MinInt64, "EUR")},
+		{name: "max negated", m: New(math.MaxInt64, "EUR"), n: -1, want: New(-math.MaxInt64, "EUR")},
+		{name: "negate", m: New(42, "EUR"), n: -1, want: New(-42, "EUR")},
+		{name: "min negated", m: New(math.MinInt64, "EUR"), n: -1, err: ErrOverflow},
+		{name: "minus one by min", m: New(-1, "EUR"), n: math.MinInt64, err: ErrOverflow},
+		{name: "max doubled", m: New(math.MaxInt64, "EUR"), n: 2, err: ErrOverflow},
+		{name: "min doubled", m: New(math.MinInt64, "EUR"), n: 2, err: ErrOverflow},
+		{name: "half max doubled", m: New(math.MaxInt64/2+1, "EUR"), n: 2, err: ErrOverflow},
+		{name: "large quantity", m: New(1<<32, "EUR"), n: 1 << 32, err: ErrOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Mul(tt.m, tt.n)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Mul(%s, %d) error = %v, want %v", String(tt.m), tt.n, err, tt.err)
+			}
+			if tt.err == nil && !Equal(got, tt.want) {
+				t.Errorf("Mul(%s, %d) = %s, want %s", String(tt.m), tt.n, String(got), String(tt.want))
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		m     *pb.Money
+		valid bool
+	}{
+		{name: "valid", m: New(100, "USD"), valid: true},
+		{name: "zero", m: New(0, "JPY"), valid: true},
+		{name: "max", m: New(math.MaxInt64, "EUR"), valid: true},
+		{name: "negative", m: New(-1, "USD")},
+		{name: "min", m: New(math.MinInt64, "USD")},
+		{name: "nil", m: nil},
+		{name: "empty currency", m: New(1, "")},
+		{name: "lowercase", m: New(1, "usd")},
+		{name: "mixed case", m: New(1, "Usd")},
+		{name: "too short", m: New(1, "US")},
+		{name: "too long", m: New(1, "USDT")},
+		{name: "digits", m: New(1, "123")},
+		{name: "space", m: New(1, "US ")},
+		{name: "multibyte", m: New(1, "ÜS")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.m)
+			if tt.valid && err != nil {
+				t.Errorf("Validate(%s) = %v, want nil", String(tt.m), err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("Validate(%s) = nil, want an error", String(tt.m))
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *pb.Money
+		want *pb.Money
+	}{
+		{name: "nil", m: nil, want: New(0, DefaultCurrency)},
+		{name: "missing currency", m: New(120, ""), want: New(120, DefaultCurrency)},
+		{name: "currency kept", m: New(120, "EUR"), want: New(120, "EUR")},
+		{name: "negative kept", m: New(-5, ""), want: New(-5, DefaultCurrency)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Normalize(tt.m); !Equal(got, tt.want) {
+				t.Errorf("Normalize(%s) = %s, want %s", String(tt.m), String(got), String(tt.want))
+			}
+		})
+	}
+}
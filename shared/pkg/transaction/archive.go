@@ -0,0 +1,92 @@
+package transaction
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ArchiveRecord is the history of a transaction, written before the
+// transaction znodes are deleted.
+type ArchiveRecord struct {
+	TransactionState
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+type Archiver interface {
+	Archive(record ArchiveRecord) error
+	Search(query TransactionQuery) ([]ArchiveRecord, error)
+}
+
+// fileArchiver appends one JSON record per line to a local file
+type fileArchiver struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileArchiver(path string) (*fileArchiver, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error in open archive file %s: %v", path, err)
+	}
+	file.Close()
+
+	return &fileArchiver{path: path}, nil
+}
+
+func (a *fileArchiver) Archive(record ArchiveRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error in marshal archive record %s: %v", record.Id, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error in open archive file %s: %v", a.path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error in write archive record %s: %v", record.Id, err)
+	}
+
+	// the znodes are deleted right after, so the record must reach the disk
+	return file.Sync()
+}
+
+func (a *fileArchiver) Search(query TransactionQuery) ([]ArchiveRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("error in open archive file %s: %v", a.path, err)
+	}
+	defer file.Close()
+
+	var records []ArchiveRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record ArchiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("error in unmarshal archive record: %v", err)
+		}
+
+		if query.Match(record.TransactionData) {
+			records = append(records, record)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error in read archive file %s: %v", a.path, err)
+	}
+
+	return records, nil
+}
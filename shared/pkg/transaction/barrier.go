@@ -0,0 +1,138 @@
+package transaction
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+)
+
+// Every transaction owns three barriers under /transactions/barriers/<id>.
+// The prepare barrier is removed by the coordinator to start phase 1, the
+// vote double barrier makes the participants enter and leave phase 1
+// together, and the decision barrier is removed once every participant has
+// its decision, to start phase 2.
+const (
+	prepareBarrier  = "prepare"
+	voteBarrier     = "vote"
+	decisionBarrier = "decision"
+)
+
+func (tm *transactionManager) setBarriers(txId string) error {
+	path := tm.barrierPath + "/" + txId
+	if err := tm.client.CreateIfNotExists(path, []byte{}); err != nil {
+		return fmt.Errorf("error in create transaction %s barriers: %v", txId, err)
+	}
+
+	for _, name := range []string{prepareBarrier, decisionBarrier} {
+		if err := zkclient.NewBarrier(tm.client, path+"/"+name).Set(); err != nil {
+			return fmt.Errorf("error in set transaction %s %s barrier: %v", txId, name, err)
+		}
+	}
+
+	return nil
+}
+
+// EnterPrepare blocks until the coordinator starts phase 1 and every
+// participant has entered it. It returns false when the participant must
+// not prepare, because the transaction expired or was decided meanwhile,
+// and the abort vote has been written for it.
+func (tw *transactionWatcher) EnterPrepare(txData TransactionData, participant string) (bool, error) {
+	ctx, cancel := tw.phaseContext(txData)
+	defer cancel()
+
+	path := tw.basePath + "/" + string(txData.Type) + "/" + txData.Id + "/" + participant
+	barrierPath := tw.barrierPath + "/" + txData.Id
+
+	if err := zkclient.NewBarrier(tw.client, barrierPath+"/"+prepareBarrier).Wait(ctx); err != nil {
+		tw.abortPhase(path, err)
+		return false, fmt.Errorf("error in wait transaction %s prepare: %v", txData.Id, err)
+	}
+
+	data, err := tw.client.Get(path)
+	if err != nil {
+		return false, fmt.Errorf("error in get znode %s: %v", path, err)
+	}
+	if string(data) != string(StatusPrepared) {
+		return false, nil
+	}
+
+	size := len(txData.Participants)
+	if err := zkclient.NewDoubleBarrier(tw.client, barrierPath+"/"+voteBarrier, participant, size).Enter(ctx); err != nil {
+		tw.abortPhase(path, err)
+		return false, fmt.Errorf("error in enter transaction %s phase 1: %v", txData.Id, err)
+	}
+
+	// refuse to prepare work whose deadline has already passed
+	if txData.Expired() {
+		log.Printf("transaction %s expired at %s, refuse to prepare\n", txData.Id, txData.Deadline)
+		tw.abortPhase(path, context.DeadlineExceeded)
+		tw.LeavePrepare(txData, participant)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// LeavePrepare waits until every participant has voted
+func (tw *transactionWatcher) LeavePrepare(txData TransactionData, participant string) {
+	ctx, cancel := tw.phaseContext(txData)
+	defer cancel()
+
+	path := tw.barrierPath + "/" + txData.Id + "/" + voteBarrier
+	if err := zkclient.NewDoubleBarrier(tw.client, path, participant, len(txData.Participants)).Leave(ctx); err != nil {
+		log.Printf("error in leave transaction %s phase 1: %v\n", txData.Id, err)
+	}
+}
+
+// WaitDecision blocks until the coordinator has written the decision of
+// every participant.
+func (tw *transactionWatcher) WaitDecision(txId string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-tw.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	path := tw.barrierPath + "/" + txId + "/" + decisionBarrier
+	if err := zkclient.NewBarrier(tw.client, path).Wait(ctx); err != nil {
+		return fmt.Errorf("error in wait transaction %s decision: %v", txId, err)
+	}
+
+	return nil
+}
+
+// phaseContext is done at the transaction deadline, or as soon as the
+// decision is written since waiting for the others is pointless then.
+func (tw *transactionWatcher) phaseContext(txData TransactionData) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if !txData.Deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(context.Background(), txData.Deadline)
+	}
+
+	go func() {
+		path := tw.barrierPath + "/" + txData.Id + "/" + decisionBarrier
+		if err := zkclient.NewBarrier(tw.client, path).Wait(ctx); err == nil {
+			cancel()
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// abortPhase votes abort when phase 1 could not start in time
+func (tw *transactionWatcher) abortPhase(path string, err error) {
+	reason := AbortReason{Code: ReasonInternal, Message: err.Error()}
+	if err == context.DeadlineExceeded {
+		reason = AbortReason{Code: ReasonExpired, Message: "transaction deadline exceeded"}
+	}
+
+	if err := tw.voteAbort(path, reason); err != nil {
+		log.Println(err)
+	}
+}
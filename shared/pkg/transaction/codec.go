@@ -0,0 +1,262 @@
+package transaction
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SchemaVersion is written into every transaction znode. Transactions
+// written before the version existed read as version 0.
+const SchemaVersion = 1
+
+// Codec encodes the transaction znodes. JSON is written as is, so older
+// participants can still read it, the other codecs are framed with their
+// name so every reader decodes them without being configured.
+type Codec interface {
+	Name() string
+	Marshal(txData TransactionData) ([]byte, error)
+	Unmarshal(data []byte, txData *TransactionData) error
+}
+
+var (
+	JSONCodec  Codec = jsonCodec{}
+	ProtoCodec Codec = protoCodec{}
+)
+
+var (
+	codecs  = make(map[string]Codec)
+	codecMu sync.RWMutex
+)
+
+func init() {
+	for _, codec := range []Codec{JSONCodec, ProtoCodec, CompressedCodec(JSONCodec), CompressedCodec(ProtoCodec)} {
+		RegisterCodec(codec)
+	}
+}
+
+// RegisterCodec makes a codec known to the readers by its name
+func RegisterCodec(codec Codec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+// LookupCodec returns a registered codec, e.g. "json", "proto" or "gzip+proto"
+func LookupCodec(name string) (Codec, bool) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// a framed znode starts with a zero byte, the name length and the name
+func encodeTransaction(codec Codec, txData TransactionData) ([]byte, error) {
+	txData.Version = SchemaVersion
+
+	data, err := codec.Marshal(txData)
+	if err != nil {
+		return nil, fmt.Errorf("error in marshal transaction data with %s: %v", codec.Name(), err)
+	}
+
+	if codec.Name() == JSONCodec.Name() {
+		return data, nil
+	}
+
+	name := codec.Name()
+	frame := make([]byte, 0, 2+len(name)+len(data))
+	frame = append(frame, 0, byte(len(name)))
+	frame = append(frame, name...)
+
+	return append(frame, data...), nil
+}
+
+func decodeTransaction(data []byte) (TransactionData, error) {
+	codec := JSONCodec
+	if len(data) > 0 && data[0] == 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return TransactionData{}, fmt.Errorf("error in decode transaction data: truncated frame")
+		}
+
+		name := string(data[2 : 2+int(data[1])])
+		var ok bool
+		if codec, ok = LookupCodec(name); !ok {
+			return TransactionData{}, fmt.Errorf("error in decode transaction data: unknown codec %s", name)
+		}
+		data = data[2+int(data[1]):]
+	}
+
+	var txData TransactionData
+	if err := codec.Unmarshal(data, &txData); err != nil {
+		return TransactionData{}, fmt.Errorf("error in unmarshal transaction data with %s: %v", codec.Name(), err)
+	}
+
+	if txData.Version > SchemaVersion {
+		return TransactionData{}, fmt.Errorf("unsupported transaction schema version %d", txData.Version)
+	}
+
+	return txData, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(txData TransactionData) ([]byte, error) {
+	return json.Marshal(txData)
+}
+
+func (jsonCodec) Unmarshal(data []byte, txData *TransactionData) error {
+	return json.Unmarshal(data, txData)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) Marshal(txData TransactionData) ([]byte, error) {
+	message := &pb.TransactionData{
+		Id:             txData.Id,
+		Type:           string(txData.Type),
+		Timestamp:      toTimestamp(txData.Timestamp),
+		Deadline:       toTimestamp(txData.Deadline),
+		Payload:        txData.Payload,
+		Status:         string(txData.Status),
+		Participants:   txData.Participants,
+		Coordinator:    txData.Coordinator,
+		Epoch:          txData.Epoch,
+		Resources:      resourcesToProto(txData.Resources),
+		Version:        int32(txData.Version),
+		PayloadChunks:  int32(txData.PayloadChunks),
+		IdempotencyKey: txData.IdempotencyKey,
+	}
+
+	return proto.Marshal(message)
+}
+
+func (protoCodec) Unmarshal(data []byte, txData *TransactionData) error {
+	var message pb.TransactionData
+	if err := proto.Unmarshal(data, &message); err != nil {
+		return err
+	}
+
+	*txData = TransactionData{
+		Id:             message.Id,
+		Type:           TransactionType(message.Type),
+		Timestamp:      fromTimestamp(message.Timestamp),
+		Deadline:       fromTimestamp(message.Deadline),
+		Payload:        message.Payload,
+		Status:         TransactionStatus(message.Status),
+		Participants:   message.Participants,
+		Coordinator:    message.Coordinator,
+		Epoch:          message.Epoch,
+		Resources:      resourcesFromProto(message.Resources),
+		Version:        int(message.Version),
+		PayloadChunks:  int(message.PayloadChunks),
+		IdempotencyKey: message.IdempotencyKey,
+	}
+
+	return nil
+}
+
+type compressedCodec struct {
+	codec Codec
+}
+
+// CompressedCodec gzips the output of another codec
+func CompressedCodec(codec Codec) Codec {
+	return compressedCodec{codec: codec}
+}
+
+func (c compressedCodec) Name() string {
+	return "gzip+" + c.codec.Name()
+}
+
+func (c compressedCodec) Marshal(txData TransactionData) ([]byte, error) {
+	data, err := c.codec.Marshal(txData)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c compressedCodec) Unmarshal(data []byte, txData *TransactionData) error {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err = io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	return c.codec.Unmarshal(data, txData)
+}
+
+func resourcesToProto(resources map[ResourceType]string) map[string]string {
+	if len(resources) == 0 {
+		return nil
+	}
+
+	keys := make(map[string]string, len(resources))
+	for resource, key := range resources {
+		keys[string(resource)] = key
+	}
+
+	return keys
+}
+
+func resourcesFromProto(keys map[string]string) map[ResourceType]string {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	resources := make(map[ResourceType]string, len(keys))
+	for resource, key := range keys {
+		resources[ResourceType(resource)] = key
+	}
+
+	return resources
+}
+
+func toTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	return timestamppb.New(t)
+}
+
+func fromTimestamp(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+
+	return ts.AsTime()
+}
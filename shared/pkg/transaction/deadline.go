@@ -0,0 +1,130 @@
+package transaction
+
+import (
+	"container/heap"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+)
+
+type deadlineEntry struct {
+	deadline time.Time
+	txPath   string
+	txId     string
+}
+
+// deadlineHeap orders the undecided transactions by deadline, the earliest
+// first
+type deadlineHeap []deadlineEntry
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x any)        { *h = append(*h, x.(deadlineEntry)) }
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// trackDeadlines keeps the deadlines of the undecided transactions from the
+// cache events, so expire only looks at the transactions which are due. A
+// transaction which is decided or removed is dropped from the map, its heap
+// entry is skipped once it is popped.
+func (tm *transactionManager) trackDeadlines(events <-chan zkclient.TreeEvent) {
+	tm.forEachTransaction(func(txPath string, txData TransactionData) {
+		tm.trackDeadline(txPath, txData)
+	})
+
+	for event := range events {
+		if _, ok := tm.transactionType(event.Path); !ok {
+			continue
+		}
+
+		if event.Type == zkclient.NodeRemoved {
+			tm.deadlineMu.Lock()
+			delete(tm.deadlines, event.Path)
+			tm.deadlineMu.Unlock()
+			continue
+		}
+
+		txData, err := decodeTransaction(event.Data)
+		if err != nil {
+			log.Printf("error in decode transaction %s: %v\n", event.Path, err)
+			continue
+		}
+		txData.Id = nodeName(event.Path)
+
+		tm.trackDeadline(event.Path, txData)
+	}
+}
+
+func (tm *transactionManager) trackDeadline(txPath string, txData TransactionData) {
+	tm.deadlineMu.Lock()
+	defer tm.deadlineMu.Unlock()
+
+	if txData.Deadline.IsZero() || isDecided(txData.Status) {
+		delete(tm.deadlines, txPath)
+		return
+	}
+
+	if deadline, ok := tm.deadlines[txPath]; ok && deadline.Equal(txData.Deadline) {
+		return
+	}
+	tm.deadlines[txPath] = txData.Deadline
+	heap.Push(&tm.deadlineQueue, deadlineEntry{deadline: txData.Deadline, txPath: txPath, txId: txData.Id})
+}
+
+// dueTransactions pops the transactions whose deadline has passed
+func (tm *transactionManager) dueTransactions() []deadlineEntry {
+	tm.deadlineMu.Lock()
+	defer tm.deadlineMu.Unlock()
+
+	var due []deadlineEntry
+	now := time.Now()
+	for tm.deadlineQueue.Len() > 0 && now.After(tm.deadlineQueue[0].deadline) {
+		entry := heap.Pop(&tm.deadlineQueue).(deadlineEntry)
+		if deadline, ok := tm.deadlines[entry.txPath]; !ok || !deadline.Equal(entry.deadline) {
+			continue
+		}
+		delete(tm.deadlines, entry.txPath)
+		due = append(due, entry)
+	}
+
+	return due
+}
+
+// retryDeadline puts back a transaction whose abort failed, unless it was
+// removed in the meantime
+func (tm *transactionManager) retryDeadline(entry deadlineEntry) {
+	if !tm.cache.Exists(entry.txPath) {
+		return
+	}
+
+	tm.deadlineMu.Lock()
+	defer tm.deadlineMu.Unlock()
+
+	if _, ok := tm.deadlines[entry.txPath]; ok {
+		return
+	}
+	tm.deadlines[entry.txPath] = entry.deadline
+	heap.Push(&tm.deadlineQueue, entry)
+}
+
+// transactionType returns the type of a /transactions/<type>/<id> path
+func (tm *transactionManager) transactionType(path string) (TransactionType, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, tm.basePath+"/"), "/")
+	if len(parts) != 2 {
+		return "", false
+	}
+
+	_, ok := LookupTransactionType(TransactionType(parts[0]))
+	return TransactionType(parts[0]), ok
+}
+
+func nodeName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
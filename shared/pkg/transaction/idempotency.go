@@ -0,0 +1,309 @@
+package transaction
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// DefaultIdempotencyWindow is how long an idempotency key is remembered
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// a claim without a transaction id is taken over after claimTimeout once
+// its coordinator is gone, i.e. the ephemeral claimOwner child of the claim
+// is deleted. A transaction which was begun for the claim is looked up in
+// ZooKeeper and in the archive first, so it is never begun twice.
+const (
+	claimTimeout = 10 * time.Second
+	claimOwner   = "owner"
+)
+
+// IdempotencyRecord maps an idempotency key to the transaction it began.
+// Fingerprint is the payload hash, a key must not be reused for another
+// request.
+type IdempotencyRecord struct {
+	Key           string          `json:"key"`
+	Type          TransactionType `json:"type"`
+	TransactionId string          `json:"transaction_id"`
+	Fingerprint   string          `json:"fingerprint"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// SetIdempotencyWindow replaces how long the idempotency keys are kept
+func (tm *transactionManager) SetIdempotencyWindow(window time.Duration) {
+	tm.idempotencyWindow = window
+}
+
+// BeginOnce begins the transaction only for the first request carrying the
+// key. Any request with the same key within the window gets the id of that
+// transaction and false, and waits for it when it is still beginning.
+func (tm *transactionManager) BeginOnce(key string, txType TransactionType, payload []byte, participants []string, resources map[ResourceType]string, deadline time.Time) (string, bool, error) {
+	hash := sha256.Sum256([]byte(string(txType) + "/" + key))
+	name := hex.EncodeToString(hash[:])
+	path := tm.idempotencyPath + "/" + name
+
+	fingerprint := sha256.Sum256(payload)
+	claim := IdempotencyRecord{
+		Key:         key,
+		Type:        txType,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+
+	for {
+		claim.CreatedAt = time.Now()
+		data, err := json.Marshal(claim)
+		if err != nil {
+			return "", false, fmt.Errorf("error in marshal idempotency record: %v", err)
+		}
+
+		err = tm.client.Create(path, data)
+		if err == nil {
+			if err := tm.client.CreateLockNode(path+"/"+claimOwner, []byte(tm.id)); err != nil {
+				return "", false, fmt.Errorf("error in own idempotency key %s: %v", key, err)
+			}
+			txId, err := tm.beginClaimed(path, name, claim, txType, payload, participants, resources, deadline)
+			return txId, err == nil, err
+		}
+		if err != zk.ErrNodeExists {
+			return "", false, fmt.Errorf("error in create idempotency key %s: %v", key, err)
+		}
+
+		data, version, err := tm.client.GetWithVersion(path)
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("error in get idempotency key %s: %v", key, err)
+		}
+
+		var record IdempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return "", false, fmt.Errorf("error in unmarshal idempotency key %s: %v", key, err)
+		}
+
+		if record.Fingerprint != claim.Fingerprint {
+			return "", false, fmt.Errorf("%w: %s", ErrIdempotencyConflict, key)
+		}
+		if record.TransactionId != "" {
+			log.Printf("idempotency key %s replays transaction %s\n", key, record.TransactionId)
+			return record.TransactionId, false, nil
+		}
+
+		owned, err := tm.client.Exists(path + "/" + claimOwner)
+		if err != nil {
+			return "", false, fmt.Errorf("error in get idempotency key %s owner: %v", key, err)
+		}
+
+		if !owned && time.Since(record.CreatedAt) > claimTimeout {
+			// the coordinator may have died after its begin, before it
+			// recorded the transaction on the key
+			txId, ok, err := tm.findIdempotentTransaction(txType, name)
+			if err != nil {
+				return "", false, err
+			}
+			if ok {
+				log.Printf("idempotency key %s recovers transaction %s\n", key, txId)
+				if err := tm.recordIdempotentTransaction(name, txId); err != nil {
+					return "", false, err
+				}
+				continue
+			}
+
+			log.Printf("take over abandoned idempotency key %s\n", key)
+			claim.CreatedAt = time.Now()
+			data, err := json.Marshal(claim)
+			if err != nil {
+				return "", false, fmt.Errorf("error in marshal idempotency record: %v", err)
+			}
+
+			err = tm.client.SetWithVersion(path, data, version)
+			if err == nil {
+				// another coordinator taking over at the same time lost the
+				// version check, a failure here leaves the claim unowned
+				if err := tm.client.CreateLockNode(path+"/"+claimOwner, []byte(tm.id)); err != nil {
+					return "", false, fmt.Errorf("error in own idempotency key %s: %v", key, err)
+				}
+				txId, err := tm.beginClaimed(path, name, claim, txType, payload, participants, resources, deadline)
+				return txId, err == nil, err
+			}
+			if err != zk.ErrBadVersion && err != zk.ErrNoNode {
+				return "", false, fmt.Errorf("error in take over idempotency key %s: %v", key, err)
+			}
+			continue
+		}
+
+		// the first request is still beginning its transaction, or its
+		// coordinator is alive but slow
+		_, ch, err := tm.client.GetW(path)
+		if err != nil {
+			continue
+		}
+		select {
+		case <-ch:
+		case <-time.After(claimTimeout):
+		}
+	}
+}
+
+// beginClaimed begins the transaction of a claimed key. Once the transaction
+// is begun the claim is kept until the transaction id is recorded on it.
+func (tm *transactionManager) beginClaimed(path string, name string, claim IdempotencyRecord, txType TransactionType, payload []byte, participants []string, resources map[ResourceType]string, deadline time.Time) (string, error) {
+	txId, err := tm.begin(txType, payload, participants, resources, deadline, name)
+	if err != nil {
+		// release the key, so a retry begins again
+		if err := tm.client.DeleteRecursive(path); err != nil {
+			log.Printf("error in release idempotency key %s: %v\n", claim.Key, err)
+		}
+		return "", err
+	}
+
+	claim.TransactionId = txId
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return "", fmt.Errorf("error in marshal idempotency record: %v", err)
+	}
+
+	for {
+		err := tm.client.Set(path, data)
+		if err == nil {
+			if err := tm.client.Delete(path + "/" + claimOwner); err != nil && err != zk.ErrNoNode {
+				log.Printf("error in release idempotency key %s owner: %v\n", claim.Key, err)
+			}
+			return txId, nil
+		}
+		log.Printf("error in record idempotency key %s: %v\n", claim.Key, err)
+
+		select {
+		case <-tm.stopChan:
+			return "", fmt.Errorf("error in record idempotency key %s: %v", claim.Key, err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// findIdempotentTransaction looks for the transaction begun for the key in
+// ZooKeeper, not in the cache which may lag behind, then in the archive. The
+// retention records the id on the key before it deletes the transaction.
+func (tm *transactionManager) findIdempotentTransaction(txType TransactionType, name string) (string, bool, error) {
+	txPath := tm.basePath + "/" + string(txType)
+	children, err := tm.client.Children(txPath)
+	if err != nil {
+		return "", false, fmt.Errorf("error in list %s transactions: %v", txType, err)
+	}
+
+	for _, txId := range children {
+		data, err := tm.client.Get(txPath + "/" + txId)
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("error in get transaction %s: %v", txId, err)
+		}
+
+		txData, err := decodeTransaction(data)
+		if err != nil {
+			return "", false, err
+		}
+		if txData.IdempotencyKey == name {
+			return txId, true, nil
+		}
+	}
+
+	if tm.archiver == nil {
+		return "", false, nil
+	}
+
+	records, err := tm.archiver.Search(TransactionQuery{Type: txType})
+	if err != nil {
+		return "", false, fmt.Errorf("error in search archive: %v", err)
+	}
+	for _, record := range records {
+		if record.IdempotencyKey == name {
+			return record.Id, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// recordIdempotentTransaction records the transaction id on the key, unless
+// the key already has one or expired
+func (tm *transactionManager) recordIdempotentTransaction(name string, txId string) error {
+	path := tm.idempotencyPath + "/" + name
+	for {
+		data, version, err := tm.client.GetWithVersion(path)
+		if err == zk.ErrNoNode {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error in get idempotency key %s: %v", name, err)
+		}
+
+		var record IdempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("error in unmarshal idempotency key %s: %v", name, err)
+		}
+		if record.TransactionId != "" {
+			return nil
+		}
+
+		record.TransactionId = txId
+		data, err = json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("error in marshal idempotency record: %v", err)
+		}
+
+		err = tm.client.SetWithVersion(path, data, version)
+		if err == zk.ErrBadVersion {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error in record idempotency key %s: %v", name, err)
+		}
+		return nil
+	}
+}
+
+// expireIdempotencyKeys removes the keys older than the window
+func (tm *transactionManager) expireIdempotencyKeys() {
+	children, err := tm.client.Children(tm.idempotencyPath)
+	if err != nil {
+		log.Printf("error in list idempotency keys: %v\n", err)
+		return
+	}
+
+	expired := 0
+	for _, child := range children {
+		path := tm.idempotencyPath + "/" + child
+		data, err := tm.client.Get(path)
+		if err != nil {
+			continue
+		}
+
+		var record IdempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("error in unmarshal idempotency key %s: %v\n", child, err)
+			continue
+		}
+
+		if time.Since(record.CreatedAt) < tm.idempotencyWindow {
+			continue
+		}
+
+		tm.client.Delete(path + "/" + claimOwner)
+		if err := tm.client.Delete(path); err != nil && err != zk.ErrNoNode {
+			log.Printf("error in delete idempotency key %s: %v\n", record.Key, err)
+			continue
+		}
+		expired++
+	}
+
+	if expired > 0 {
+		log.Printf("%d idempotency keys expired\n", expired)
+	}
+}
@@ -0,0 +1,257 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"path"
+	"time"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+	"github.com/go-zookeeper/zk"
+)
+
+// TransactionState is the transaction with the state of every participant,
+// a transaction is completed once every participant has committed or
+// rolled back.
+type TransactionState struct {
+	TransactionData
+	ParticipantStatus  map[string]TransactionStatus `json:"participant_status"`
+	ParticipantReasons map[string]AbortReason       `json:"participant_reasons,omitempty"`
+	Completed          bool                         `json:"completed"`
+}
+
+// TransactionQuery filters transactions, zero fields match everything.
+// Keyword is matched against the raw payload, e.g. a user or order id.
+type TransactionQuery struct {
+	Id      string
+	Type    TransactionType
+	Status  TransactionStatus
+	Keyword string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (q TransactionQuery) Match(txData TransactionData) bool {
+	if q.Id != "" && txData.Id != q.Id {
+		return false
+	}
+	if q.Type != "" && txData.Type != q.Type {
+		return false
+	}
+	if q.Status != "" && txData.Status != q.Status {
+		return false
+	}
+	if q.Keyword != "" && !bytes.Contains(txData.Payload, []byte(q.Keyword)) {
+		return false
+	}
+	if !q.Since.IsZero() && txData.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && txData.Timestamp.After(q.Until) {
+		return false
+	}
+
+	return true
+}
+
+// GetTransaction reads the transaction from ZooKeeper, not from the cache,
+// so a transaction which has just begun is found as well. A transaction
+// which was already cleaned up is read from the archive.
+func (tm *transactionManager) GetTransaction(txId string) (TransactionState, error) {
+	txPath, err := tm.findTransaction(txId)
+	if err == ErrTransactionNotFound {
+		return tm.archivedTransaction(txId)
+	}
+	if err != nil {
+		return TransactionState{}, err
+	}
+
+	get := func(path string) ([]byte, bool) {
+		data, err := tm.client.Get(path)
+		return data, err == nil
+	}
+
+	return readState(get, txPath, txPathType(txPath), txId)
+}
+
+// ListTransactions returns the cached transactions matching the query,
+// ordered by type and id. The keyword only matches inline payloads.
+func (tm *transactionManager) ListTransactions(query TransactionQuery) ([]TransactionState, error) {
+	var states []TransactionState
+	for _, txType := range TransactionTypes {
+		if query.Type != "" && query.Type != txType {
+			continue
+		}
+
+		path := tm.basePath + "/" + string(txType)
+		children, _ := tm.cache.Children(path)
+		for _, txId := range children {
+			state, err := readState(tm.cache.Get, path+"/"+txId, txType, txId)
+			if err != nil {
+				// removed by the cleanup in the meantime
+				continue
+			}
+
+			if query.Match(state.TransactionData) {
+				states = append(states, state)
+			}
+		}
+	}
+
+	return states, nil
+}
+
+// WatchTransaction sends the current state of the transaction, then every
+// state transition until the transaction completes, is removed or stop is
+// closed. The channel is closed at the end.
+func (tm *transactionManager) WatchTransaction(txId string, stop <-chan struct{}) (<-chan TransactionState, error) {
+	txPath, err := tm.findTransaction(txId)
+	if err == ErrTransactionNotFound {
+		state, err := tm.archivedTransaction(txId)
+		if err != nil {
+			return nil, err
+		}
+
+		states := make(chan TransactionState, 1)
+		states <- state
+		close(states)
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := tm.client.AddWatch(txPath, zkclient.AddWatchModePersistentRecursive)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return nil, ErrTransactionNotFound
+		}
+		return nil, err
+	}
+
+	txType := txPathType(txPath)
+	states := make(chan TransactionState)
+	go func() {
+		defer close(states)
+		defer sub.Close()
+
+		var last TransactionState
+		for {
+			state, err := readState(sub.Get, txPath, txType, txId)
+			if err != nil {
+				return
+			}
+
+			if !sameState(last, state) {
+				select {
+				case <-stop:
+					return
+				case states <- state:
+				}
+				last = state
+			}
+
+			if state.Completed {
+				return
+			}
+
+			select {
+			case <-stop:
+				return
+			case _, ok := <-sub.Events():
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return states, nil
+}
+
+func (tm *transactionManager) archivedTransaction(txId string) (TransactionState, error) {
+	if tm.archiver == nil {
+		return TransactionState{}, ErrTransactionNotFound
+	}
+
+	records, err := tm.archiver.Search(TransactionQuery{Id: txId})
+	if err != nil {
+		return TransactionState{}, err
+	}
+	if len(records) == 0 {
+		return TransactionState{}, ErrTransactionNotFound
+	}
+
+	return records[len(records)-1].TransactionState, nil
+}
+
+// readState reads the transaction and the votes of its participants
+func readState(get func(path string) ([]byte, bool), txPath string, txType TransactionType, txId string) (TransactionState, error) {
+	data, ok := get(txPath)
+	if !ok {
+		return TransactionState{}, ErrTransactionNotFound
+	}
+
+	txData, err := decodeTransaction(data)
+	if err != nil {
+		return TransactionState{}, err
+	}
+	txData.Id = txId
+	txData.Type = txType
+
+	// a participant which is not read yet keeps the transaction pending
+	state := TransactionState{
+		TransactionData:   txData,
+		ParticipantStatus: make(map[string]TransactionStatus),
+		Completed:         true,
+	}
+	for _, participant := range txData.Participants {
+		data, ok := get(txPath + "/" + participant)
+		if !ok {
+			state.Completed = false
+			continue
+		}
+
+		status := TransactionStatus(data)
+		state.ParticipantStatus[participant] = status
+		if status != StatusCommitted && status != StatusRolledBack {
+			state.Completed = false
+		}
+
+		// the reason of an abort vote is kept with the state, so a replay or
+		// the archive still tells why the transaction was aborted
+		if data, ok := get(txPath + "/" + participant + "/" + reasonNode); ok {
+			var reason AbortReason
+			if err := json.Unmarshal(data, &reason); err != nil {
+				log.Printf("error in unmarshal abort reason of %s/%s: %v\n", txId, participant, err)
+				continue
+			}
+			if state.ParticipantReasons == nil {
+				state.ParticipantReasons = make(map[string]AbortReason)
+			}
+			state.ParticipantReasons[participant] = reason
+		}
+	}
+
+	return state, nil
+}
+
+func sameState(a TransactionState, b TransactionState) bool {
+	if a.Status != b.Status || len(a.ParticipantStatus) != len(b.ParticipantStatus) {
+		return false
+	}
+
+	for participant, status := range a.ParticipantStatus {
+		if b.ParticipantStatus[participant] != status {
+			return false
+		}
+	}
+
+	return true
+}
+
+// txPathType returns the type of /transactions/<type>/<id>
+func txPathType(txPath string) TransactionType {
+	return TransactionType(path.Base(path.Dir(txPath)))
+}
@@ -0,0 +1,256 @@
+package transaction
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// Run joins the coordinator leader election. Every replica can coordinate
+// its own transactions, but only the leader recovers orphaned transactions
+// cleans up the completed ones and aborts the expired ones.
+func (tm *transactionManager) Run() {
+	log.Printf("coordinator %s joins leader election\n", tm.id)
+
+	tm.wg.Add(1)
+	go func() {
+		defer tm.wg.Done()
+		for {
+			select {
+			case <-tm.stopChan:
+				return
+			default:
+			}
+
+			isLeader, err := tm.election.Campaign(tm.stopChan)
+			if err != nil {
+				log.Printf("error in leader election: %v\n", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if !isLeader {
+				return
+			}
+
+			tm.lead()
+		}
+	}()
+}
+
+func (tm *transactionManager) Stop() {
+	close(tm.stopChan)
+	tm.wg.Wait()
+	tm.client.Unsubscribe(tm.session)
+	tm.cache.Stop()
+
+	if err := tm.election.Resign(); err != nil {
+		log.Printf("error in resign leadership: %v\n", err)
+	}
+}
+
+func (tm *transactionManager) lead() {
+	epoch, fence, err := tm.nextEpoch()
+	if err != nil {
+		log.Printf("error in increase leader epoch: %v\n", err)
+		if err := tm.election.Resign(); err != nil {
+			log.Printf("error in resign leadership: %v\n", err)
+		}
+		return
+	}
+	log.Printf("coordinator %s elected as leader at epoch %d\n", tm.id, epoch)
+
+	cleanTicker := time.NewTicker(tm.cleanInterval)
+	defer cleanTicker.Stop()
+	expireTicker := time.NewTicker(tm.expireInterval)
+	defer expireTicker.Stop()
+
+	tm.recover(fence)
+	tm.clean()
+	tm.expireIdempotencyKeys()
+
+	ch, err := tm.election.Watch()
+	for {
+		if err != nil {
+			log.Printf("coordinator %s lost leadership: %v\n", tm.id, err)
+			return
+		}
+
+		select {
+		case <-tm.stopChan:
+			return
+		case <-ch:
+			ch, err = tm.election.Watch()
+		case <-expireTicker.C:
+			tm.expire(fence)
+		case <-cleanTicker.C:
+			tm.recover(fence)
+			tm.clean()
+			tm.expireIdempotencyKeys()
+		}
+	}
+}
+
+// recover takes over the transactions whose coordinator is no longer alive.
+// Undecided transactions are committed only when every participant voted
+// ready, otherwise they are rolled back. The writes are fenced by the epoch
+// version of this leader, a deposed leader cannot write anymore.
+func (tm *transactionManager) recover(fence int32) {
+	members, err := tm.election.Members()
+	if err != nil {
+		log.Printf("error in list coordinators: %v\n", err)
+		return
+	}
+
+	alive := make(map[string]bool)
+	for _, member := range members {
+		alive[member] = true
+	}
+
+	tm.forEachTransaction(func(txPath string, txData TransactionData) {
+		if alive[txData.Coordinator] {
+			return
+		}
+
+		if !isDecided(txData.Status) {
+			log.Printf("take over orphaned transaction %s from coordinator %s\n", txData.Id, txData.Coordinator)
+			isCommit, err := tm.collectVotes(txPath, txData)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			txData, err = tm.decide(txPath, txData.Id, isCommit, fence)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+
+		// the coordinator may have died in the middle of phase 2
+		if err := tm.driveParticipants(txPath, txData, fence); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// expire aborts the transactions which are still undecided after their
+// deadline, only the due ones are taken from the deadline heap
+func (tm *transactionManager) expire(fence int32) {
+	for _, entry := range tm.dueTransactions() {
+		log.Printf("transaction %s expired at %s\n", entry.txId, entry.deadline.Format(time.RFC3339))
+		txData, err := tm.decide(entry.txPath, entry.txId, false, fence)
+		if err != nil {
+			log.Println(err)
+			tm.retryDeadline(entry)
+			continue
+		}
+
+		if err := tm.driveParticipants(entry.txPath, txData, fence); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// forEachTransaction walks the cached transactions, the callers write
+// with versioned updates so a stale entry is harmless.
+func (tm *transactionManager) forEachTransaction(fn func(txPath string, txData TransactionData)) {
+	for _, txType := range TransactionTypes {
+		path := tm.basePath + "/" + string(txType)
+		children, ok := tm.cache.Children(path)
+		if !ok {
+			continue
+		}
+
+		for _, txId := range children {
+			txPath := path + "/" + txId
+			data, ok := tm.cache.Get(txPath)
+			if !ok {
+				continue
+			}
+
+			txData, err := decodeTransaction(data)
+			if err != nil {
+				log.Printf("error in decode transaction %s: %v\n", txId, err)
+				continue
+			}
+			txData.Id = txId
+
+			fn(txPath, txData)
+		}
+	}
+}
+
+// collectVotes reads the votes without waiting, a participant which has
+// not voted yet counts as abort.
+func (tm *transactionManager) collectVotes(txPath string, txData TransactionData) (bool, error) {
+	if txData.Status != StatusPrepared {
+		return false, nil
+	}
+
+	for _, participant := range txData.Participants {
+		path := txPath + "/" + participant
+		data, err := tm.client.Get(path)
+		if err != nil {
+			if err == zk.ErrNoNode {
+				return false, nil
+			}
+			return false, fmt.Errorf("error in get znode %s: %v", path, err)
+		}
+
+		if string(data) != string(StatusReady) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// currentEpoch returns the leader epoch with the version of its znode, the
+// version fences the writes made at this epoch
+func (tm *transactionManager) currentEpoch() (int64, int32, error) {
+	data, version, err := tm.client.GetWithVersion(tm.epochPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error in get leader epoch: %v", err)
+	}
+
+	epoch, err := parseEpoch(data)
+	return epoch, version, err
+}
+
+// nextEpoch increases the leader epoch, every new leader owns a new epoch
+// and the znode version it wrote
+func (tm *transactionManager) nextEpoch() (int64, int32, error) {
+	for {
+		epoch, version, err := tm.currentEpoch()
+		if err != nil {
+			return 0, 0, err
+		}
+		epoch++
+
+		err = tm.client.SetWithVersion(tm.epochPath, []byte(strconv.FormatInt(epoch, 10)), version)
+		if err == zk.ErrBadVersion {
+			continue
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("error in set leader epoch: %v", err)
+		}
+
+		return epoch, version + 1, nil
+	}
+}
+
+func parseEpoch(data []byte) (int64, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	epoch, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error in parse leader epoch %s: %v", data, err)
+	}
+
+	return epoch, nil
+}
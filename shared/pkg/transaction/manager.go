@@ -1,7 +1,6 @@
 package transaction
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"sync"
@@ -9,53 +8,131 @@ import (
 
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
 	"github.com/go-zookeeper/zk"
+	"github.com/google/uuid"
 )
 
 type transactionManager struct {
-	client   *zkclient.ZooKeeperClient
-	basePath string
-	lockPath string
+	id                string
+	client            *zkclient.ZooKeeperClient
+	cache             *zkclient.TreeCache
+	election          *zkclient.Election
+	basePath          string
+	lockPath          string
+	barrierPath       string
+	payloadPath       string
+	electionPath      string
+	epochPath         string
+	cleanupPath       string
+	auditPath         string
+	idempotencyPath   string
+	idempotencyWindow time.Duration
+	cleanInterval     time.Duration
+	retention         RetentionPolicy
+	archiver          Archiver
+	codec             Codec
+	chunkSize         int
+	expireInterval    time.Duration
+	stopChan          chan struct{}
+	wg                sync.WaitGroup
+	session           <-chan zkclient.SessionEvent
+	mu                sync.Mutex
+	inflight          map[string]string
+	deadlineMu        sync.Mutex
+	deadlines         map[string]time.Time
+	deadlineQueue     deadlineHeap
 }
 
 func NewTransactionManager(client *zkclient.ZooKeeperClient) (*transactionManager, error) {
 	tm := &transactionManager{
-		client:   client,
-		basePath: "/transactions",
-		lockPath: "/transactions/locks",
+		id:                uuid.New().String(),
+		client:            client,
+		basePath:          "/transactions",
+		lockPath:          "/transactions/locks",
+		barrierPath:       "/transactions/barriers",
+		payloadPath:       "/transactions/payloads",
+		electionPath:      "/coordinator/election",
+		epochPath:         "/coordinator/epoch",
+		cleanupPath:       "/coordinator/cleanup",
+		auditPath:         "/coordinator/audit",
+		idempotencyPath:   "/coordinator/idempotency",
+		idempotencyWindow: DefaultIdempotencyWindow,
+		cleanInterval:     time.Duration(time.Minute),
+		retention:         DefaultRetentionPolicy,
+		codec:             JSONCodec,
+		chunkSize:         DefaultChunkSize,
+		expireInterval:    time.Duration(time.Second),
+		stopChan:          make(chan struct{}),
+		inflight:          make(map[string]string),
+		deadlines:         make(map[string]time.Time),
 	}
+	tm.election = zkclient.NewElection(client, tm.electionPath, tm.id)
 
 	if err := tm.init(); err != nil {
 		return nil, err
 	}
 
-	go tm.clean()
+	// /transactions/<type>/<id>/<participant>/reason
+	tm.cache = zkclient.NewTreeCache(client, tm.basePath, 4)
+	tm.cache.Start()
+	go tm.trackDeadlines(tm.cache.Subscribe())
+
+	tm.session = client.Subscribe()
+	go tm.watchSession(tm.session)
 
 	return tm, nil
 }
 
 // our isolation level is serialization
-func (tm *transactionManager) Begin(txType TransactionType, payload []byte, participants []string, resources []ResourceType) (string, error) {
+// a zero deadline falls back to the timeout of the transaction type policy
+func (tm *transactionManager) Begin(txType TransactionType, payload []byte, participants []string, resources map[ResourceType]string, deadline time.Time) (string, error) {
+	return tm.begin(txType, payload, participants, resources, deadline, "")
+}
+
+func (tm *transactionManager) begin(txType TransactionType, payload []byte, participants []string, resources map[ResourceType]string, deadline time.Time, idempotencyKey string) (string, error) {
 	log.Printf("begin transaction %s\n", txType)
 
+	if deadline.IsZero() {
+		if spec, ok := LookupTransactionType(txType); ok && spec.Policy.Timeout > 0 {
+			deadline = time.Now().Add(spec.Policy.Timeout)
+		}
+	}
+
 	txPath := tm.basePath + "/" + string(txType)
 	txData := TransactionData{
-		Id:           "",
-		Type:         txType,
-		Timestamp:    time.Now(),
-		Payload:      payload,
-		Status:       StatusInit,
-		Participants: participants,
-	}
-	data, err := json.Marshal(txData)
+		Id:             "",
+		Type:           txType,
+		Timestamp:      time.Now(),
+		Deadline:       deadline,
+		Payload:        payload,
+		Status:         StatusInit,
+		Participants:   participants,
+		Coordinator:    tm.id,
+		Resources:      resources,
+		IdempotencyKey: idempotencyKey,
+	}
+	if tm.chunked(payload) {
+		txData.Payload = nil
+		txData.PayloadChunks = (len(payload) + tm.chunkSize - 1) / tm.chunkSize
+	}
+	data, err := tm.encode(txData)
 	if err != nil {
-		return "", fmt.Errorf("error in marshal transaction data: %v", err)
+		return "", err
 	}
 
-	txId, err := tm.client.CreateSequential(txPath+"/", data)
+	// the sequence is kept per type, the prefix makes the id unique across
+	// types for the barriers, the payloads and the prepared transactions
+	txId, err := tm.client.CreateSequential(txPath+"/"+string(txType)+"-", data)
 	if err != nil {
 		return "", fmt.Errorf("error in create znode: %v", err)
 	}
 
+	// nobody reads the payload before the transaction is prepared
+	if txData.PayloadChunks > 0 {
+		if err := tm.writePayload(txId, payload); err != nil {
+			return "", err
+		}
+	}
+
 	for _, participant := range participants {
 		path := txPath + "/" + txId + "/" + participant
 		if err := tm.client.Create(path, []byte(StatusInit)); err != nil {
@@ -63,286 +140,407 @@ func (tm *transactionManager) Begin(txType TransactionType, payload []byte, part
 		}
 	}
 
+	if err := tm.setBarriers(txId); err != nil {
+		return "", err
+	}
+
+	tm.mu.Lock()
+	tm.inflight[txId] = txPath + "/" + txId
+	tm.mu.Unlock()
+
 	return txId, nil
 }
 
 func (tm *transactionManager) Prepare(txId string) error {
 	log.Printf("prepare transaction %s\n", txId)
 
-	for _, txType := range TransactionTypes {
-		txPath := tm.basePath + "/" + string(txType) + "/" + txId
-		exists, err := tm.client.Exists(txPath)
+	txPath, err := tm.findTransaction(txId)
+	if err != nil {
+		return err
+	}
+
+	for {
+		data, version, err := tm.client.GetWithVersion(txPath)
 		if err != nil {
-			return fmt.Errorf("error in check path: %v", err)
+			return fmt.Errorf("error in get znode %s: %v", txPath, err)
 		}
 
-		if exists {
-			data, err := tm.client.Get(txPath)
-			if err != nil {
-				return fmt.Errorf("error in get znode %s: %v", txPath, err)
-			}
+		log.Printf("set %s status to prepared\n", txId)
+		txData, err := decodeTransaction(data)
+		if err != nil {
+			return fmt.Errorf("error in decode transaction %s: %v", txId, err)
+		}
 
-			log.Printf("set %s status to prepared\n", txId)
-			var txData TransactionData
-			if err := json.Unmarshal(data, &txData); err != nil {
-				return fmt.Errorf("error in unmarshal transaction %s data: %v", txId, err)
-			}
-			txData.Status = StatusPrepared
-			data, err = json.Marshal(txData)
-			if err != nil {
-				return fmt.Errorf("error in marshal transaction %s data: %v", txId, err)
-			}
-			if err := tm.client.Set(txPath, data); err != nil {
-				return fmt.Errorf("error in set znode %s value: %v", txPath, err)
-			}
+		// the leader may have aborted the transaction in the meantime
+		if isDecided(txData.Status) {
+			return fmt.Errorf("transaction %s already decided: %s", txId, txData.Status)
+		}
 
-			children, err := tm.client.Children(txPath)
-			if err != nil {
-				return fmt.Errorf("error in list children: %v", err)
+		txData.Status = StatusPrepared
+		data, err = tm.encode(txData)
+		if err != nil {
+			return err
+		}
+		if err := tm.client.SetWithVersion(txPath, data, version); err != nil {
+			if err == zk.ErrBadVersion {
+				continue
 			}
+			return fmt.Errorf("error in set znode %s value: %v", txPath, err)
+		}
+		break
+	}
 
-			log.Printf("set %s participants status to prepared\n", txId)
-			for _, child := range children {
-				path := txPath + "/" + child
-				tm.client.Set(path, []byte(StatusPrepared))
-			}
+	children, err := tm.client.Children(txPath)
+	if err != nil {
+		return fmt.Errorf("error in list children: %v", err)
+	}
 
-			log.Printf("transaction %s prepared\n", txId)
-			return nil
+	log.Printf("set %s participants status to prepared\n", txId)
+	for _, child := range children {
+		path := txPath + "/" + child
+		data, version, err := tm.client.GetWithVersion(path)
+		if err != nil {
+			return fmt.Errorf("error in get znode %s: %v", path, err)
 		}
+		if string(data) != string(StatusInit) {
+			continue
+		}
+		tm.client.SetWithVersion(path, []byte(StatusPrepared), version)
+	}
+
+	// let the participants start phase 1 together
+	if err := zkclient.NewBarrier(tm.client, tm.barrierPath+"/"+txId+"/"+prepareBarrier).Remove(); err != nil {
+		return fmt.Errorf("error in remove prepare barrier: %v", err)
 	}
 
-	return fmt.Errorf("transaction id not found")
+	log.Printf("transaction %s prepared\n", txId)
+	return nil
 }
 
-func (tm *transactionManager) GetVotesResult(txId string) (bool, error) {
+func (tm *transactionManager) GetVotesResult(txId string) (VoteResult, error) {
 	log.Printf("get %s votes results\n", txId)
 
-	for _, txType := range TransactionTypes {
-		txPath := tm.basePath + "/" + string(txType) + "/" + txId
+	txPath, err := tm.findTransaction(txId)
+	if err != nil {
+		return VoteResult{}, err
+	}
 
-		log.Printf("check %s\n", txPath)
-		exists, err := tm.client.Exists(txPath)
-		if err != nil {
-			return false, fmt.Errorf("error in check path: %v", err)
-		}
+	data, err := tm.client.Get(txPath)
+	if err != nil {
+		return VoteResult{}, fmt.Errorf("error in get znode %s: %v", txPath, err)
+	}
 
-		if exists {
-			log.Printf("get %s votes results\n", txId)
-			data, err := tm.client.Get(txPath)
-			if err != nil {
-				return false, fmt.Errorf("error in get znode %s: %v", txPath, err)
-			}
+	txData, err := decodeTransaction(data)
+	if err != nil {
+		return VoteResult{}, fmt.Errorf("error in decode transaction %s: %v", txId, err)
+	}
 
-			var txData TransactionData
-			if err := json.Unmarshal(data, &txData); err != nil {
-				return false, fmt.Errorf("error in unmarshal transaction %s data: %v", txId, err)
+	// stop waiting for the votes once the deadline has passed, the
+	// channel is closed so every participant sees it
+	expired := make(chan struct{})
+	if !txData.Deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(txData.Deadline), func() { close(expired) })
+		defer timer.Stop()
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	result := VoteResult{
+		Commit:  true,
+		Votes:   make(map[string]TransactionStatus),
+		Reasons: make(map[string]AbortReason),
+	}
+	for _, participant := range txData.Participants {
+		path := txPath + "/" + participant
+		wg.Add(1)
+		go func(participant string) {
+			defer wg.Done()
+			vote := func(status TransactionStatus, reason *AbortReason) {
+				mu.Lock()
+				result.Votes[participant] = status
+				result.Commit = result.Commit && reason == nil
+				if reason != nil {
+					result.Reasons[participant] = *reason
+				}
+				mu.Unlock()
 			}
 
-			var wg sync.WaitGroup
-			isCommit := true
-			for _, participant := range txData.Participants {
-				path := txPath + "/" + participant
-				wg.Add(1)
-				go func(znode string) {
-					defer wg.Done()
-
-					log.Printf("get %s votes results\n", znode)
-					for {
-						data, ch, err := tm.client.GetW(path)
-						if err != nil {
-							if err == zk.ErrNoNode {
-								log.Printf("znode %s not found\n", path)
-							} else {
-								log.Printf("error in set watches %s: %v", path, err)
-							}
-							isCommit = false
-							return
-						}
-
-						log.Printf("%s votes results: %v\n", znode, string(data))
-
-						if string(data) == string(StatusReady) {
-							return
-						} else if string(data) == string(StatusAbort) {
-							isCommit = false
-							return
-						}
-
-						<-ch
+			log.Printf("get %s votes results\n", path)
+			for {
+				data, ch, err := tm.client.GetW(path)
+				if err != nil {
+					if err == zk.ErrNoNode {
+						log.Printf("znode %s not found\n", path)
+					} else {
+						log.Printf("error in set watches %s: %v", path, err)
 					}
-				}(path)
-			}
+					vote("", &AbortReason{Code: ReasonInternal, Message: "participant vote is missing"})
+					return
+				}
 
-			wg.Wait()
+				log.Printf("%s votes results: %v\n", path, string(data))
+
+				status := TransactionStatus(data)
+				if status == StatusReady {
+					vote(status, nil)
+					return
+				} else if status == StatusAbort {
+					reason := readReason(tm.client, path)
+					vote(status, &reason)
+					return
+				} else if status != StatusInit && status != StatusPrepared {
+					// the transaction was rolled back by the leader
+					vote(status, &AbortReason{Code: ReasonInternal, Message: "transaction rolled back"})
+					return
+				}
 
-			return isCommit, nil
-		}
+				select {
+				case <-ch:
+				case <-expired:
+					log.Printf("%s votes timeout\n", path)
+					vote(status, &AbortReason{Code: ReasonVoteTimeout, Message: participant + " did not vote in time"})
+					return
+				}
+			}
+		}(participant)
 	}
 
-	return false, fmt.Errorf("transaction id not found")
+	wg.Wait()
+
+	return result, nil
 }
 
-func (tm *transactionManager) Finalize(txId string, isCommit bool) error {
+func (tm *transactionManager) Finalize(txId string, isCommit bool) (bool, error) {
 	log.Println("finalize transaction " + txId)
 
+	defer func() {
+		tm.mu.Lock()
+		delete(tm.inflight, txId)
+		tm.mu.Unlock()
+	}()
+
+	txPath, err := tm.findTransaction(txId)
+	if err != nil {
+		return false, err
+	}
+
+	txData, err := tm.decide(txPath, txId, isCommit, unfenced)
+	if err != nil {
+		return false, err
+	}
+
+	if err := tm.driveParticipants(txPath, txData, unfenced); err != nil {
+		return false, err
+	}
+
+	return isCommitted(txData.Status), nil
+}
+
+// unfenced writes are made by the coordinator of the transaction, which does
+// not need to be the leader
+const unfenced int32 = -1
+
+// decide writes the decision into the transaction znode. The write is
+// versioned, so when another coordinator has decided first its decision
+// wins and is returned instead. It also checks that the epoch it records is
+// still the current one, and with a fence that it is the epoch of the leader
+// which decides, otherwise ErrNotLeader is returned.
+func (tm *transactionManager) decide(txPath string, txId string, isCommit bool, fence int32) (TransactionData, error) {
 	value := StatusRollBack
 	if isCommit {
 		value = StatusCommit
 	}
 
-	for _, txType := range TransactionTypes {
-		txPath := tm.basePath + "/" + string(txType) + "/" + txId
+	for {
+		data, version, err := tm.client.GetWithVersion(txPath)
+		if err != nil {
+			return TransactionData{}, fmt.Errorf("error in get znode %s: %v", txPath, err)
+		}
 
-		exists, err := tm.client.Exists(txPath)
+		txData, err := decodeTransaction(data)
 		if err != nil {
-			return fmt.Errorf("error in check transaction path %s: %v", txPath, err)
+			return TransactionData{}, fmt.Errorf("error in decode transaction %s: %v", txId, err)
 		}
+		txData.Id = txId
 
-		if exists {
-			data, err := tm.client.Get(txPath)
-			if err != nil {
-				return fmt.Errorf("error in get znode %s: %v", txPath, err)
-			}
+		if isDecided(txData.Status) {
+			log.Printf("transaction %s already decided %s by %s at epoch %d\n", txId, txData.Status, txData.Coordinator, txData.Epoch)
+			return txData, nil
+		}
 
-			var txData TransactionData
-			if err := json.Unmarshal(data, &txData); err != nil {
-				return fmt.Errorf("error in unmarshal transaction %s data: %v", txId, err)
-			}
-			txData.Status = value
+		epoch, epochVersion, err := tm.currentEpoch()
+		if err != nil {
+			return TransactionData{}, err
+		}
+		if fence != unfenced && epochVersion != fence {
+			return TransactionData{}, fmt.Errorf("error in decide transaction %s: %w", txId, ErrNotLeader)
+		}
+		txData.Status = value
+		txData.Coordinator = tm.id
+		txData.Epoch = epoch
 
-			data, err = json.Marshal(txData)
-			if err != nil {
-				return fmt.Errorf("error in marshal transaction %s data: %v", txId, err)
-			}
+		data, err = tm.encode(txData)
+		if err != nil {
+			return TransactionData{}, err
+		}
 
-			log.Printf("write %s status to %s\n", txId, value)
-			if err := tm.client.Set(txPath, data); err != nil {
-				return fmt.Errorf("error in set znode %s value: %v", txPath, err)
+		log.Printf("write %s status to %s at epoch %d\n", txId, value, epoch)
+		if err := tm.client.SetWithVersionFenced(txPath, data, version, tm.epochPath, epochVersion); err != nil {
+			if err == zk.ErrBadVersion || (err == zkclient.ErrFenced && fence == unfenced) {
+				continue
 			}
-
-			for _, participant := range txData.Participants {
-				path := txPath + "/" + participant
-				data, err := tm.client.Get(path)
-				if err != nil {
-					return fmt.Errorf("error in get znode %s: %v", path, err)
-				}
-
-				if string(data) == string(StatusReady) {
-					log.Printf("write %s/%s status to %s\n", txId, participant, value)
-					if err := tm.client.Set(path, []byte(value)); err != nil {
-						log.Printf("error in set znode %s value: %v\n", path, err)
-					}
-				} else {
-					log.Printf("write %s/%s status to %s\n", txId, participant, StatusRolledBack)
-					if err := tm.client.Set(path, []byte(StatusRolledBack)); err != nil {
-						log.Printf("error in set znode %s value: %v\n", path, err)
-					}
-				}
+			if err == zkclient.ErrFenced {
+				return TransactionData{}, fmt.Errorf("error in decide transaction %s: %w", txId, ErrNotLeader)
 			}
-			return nil
+			return TransactionData{}, fmt.Errorf("error in set znode %s value: %v", txPath, err)
 		}
-	}
 
-	return fmt.Errorf("transaction id not found")
+		return txData, nil
+	}
 }
 
-func (tm *transactionManager) init() error {
-	log.Println("init transaction znodes")
-	if err := tm.client.Create(tm.basePath, []byte{}); err != nil {
-		return err
+// driveParticipants pushes the decision down to the participants which
+// have not finished phase 2 yet, so it is safe to call more than once. With
+// a fence the writes stop once this leader is deposed.
+func (tm *transactionManager) driveParticipants(txPath string, txData TransactionData, fence int32) error {
+	value := StatusRollBack
+	if isCommitted(txData.Status) {
+		value = StatusCommit
 	}
 
-	for _, txType := range TransactionTypes {
-		path := tm.basePath + "/" + string(txType)
-		if err := tm.client.Create(path, []byte{}); err != nil {
-			return err
+	for _, participant := range txData.Participants {
+		path := txPath + "/" + participant
+		data, err := tm.client.Get(path)
+		if err != nil {
+			return fmt.Errorf("error in get znode %s: %v", path, err)
+		}
+
+		switch TransactionStatus(data) {
+		case StatusCommit, StatusRollBack, StatusCommitted, StatusRolledBack:
+			continue
+		case StatusReady:
+			log.Printf("write %s/%s status to %s\n", txData.Id, participant, value)
+			if err := tm.setParticipant(path, value, fence); err != nil {
+				return err
+			}
+		default:
+			log.Printf("write %s/%s status to %s\n", txData.Id, participant, StatusRolledBack)
+			if err := tm.setParticipant(path, StatusRolledBack, fence); err != nil {
+				return err
+			}
 		}
 	}
 
-	if err := tm.client.Create(tm.lockPath, []byte{}); err != nil {
-		return err
+	// every participant has its decision, let them start phase 2 together
+	if err := zkclient.NewBarrier(tm.client, tm.barrierPath+"/"+txData.Id+"/"+decisionBarrier).Remove(); err != nil {
+		return fmt.Errorf("error in remove decision barrier: %v", err)
 	}
 
-	log.Println("transaction znodes initialized")
 	return nil
 }
 
-func (tm *transactionManager) clean() {
-	interval := time.Duration(time.Minute)
-	for {
-		exists, err := tm.client.Exists(tm.basePath)
-		if err != nil || !exists {
-			log.Printf("error in check base path: %v\n", err)
-			time.Sleep(interval)
-			continue
+// setParticipant writes the status of a participant, a failed write is only
+// logged unless this leader was deposed
+func (tm *transactionManager) setParticipant(path string, status TransactionStatus, fence int32) error {
+	if fence == unfenced {
+		if err := tm.client.Set(path, []byte(status)); err != nil {
+			log.Printf("error in set znode %s value: %v\n", path, err)
 		}
+		return nil
+	}
 
-		txTypes, err := tm.client.Children(tm.basePath)
-		if err != nil {
-			log.Printf("error in list base path children: %v\n", err)
-			time.Sleep(interval)
-			continue
+	err := tm.client.SetWithVersionFenced(path, []byte(status), -1, tm.epochPath, fence)
+	if err == zkclient.ErrFenced {
+		return fmt.Errorf("error in set znode %s value: %w", path, ErrNotLeader)
+	}
+	if err != nil {
+		log.Printf("error in set znode %s value: %v\n", path, err)
+	}
+	return nil
+}
+
+// findTransaction answers from the in-flight transactions and the cache
+// first, a transaction created a moment ago may not be cached yet.
+func (tm *transactionManager) findTransaction(txId string) (string, error) {
+	tm.mu.Lock()
+	txPath, ok := tm.inflight[txId]
+	tm.mu.Unlock()
+	if ok {
+		return txPath, nil
+	}
+
+	for _, txType := range TransactionTypes {
+		txPath := tm.basePath + "/" + string(txType) + "/" + txId
+		if tm.cache.Exists(txPath) {
+			return txPath, nil
 		}
+	}
 
-		for _, txType := range txTypes {
-			path := tm.basePath + "/" + txType
-			children, err := tm.client.Children(path)
-			if err != nil {
-				log.Printf("error in list transaction type %s children: %v\n", txType, err)
-				continue
-			}
+	for _, txType := range TransactionTypes {
+		txPath := tm.basePath + "/" + string(txType) + "/" + txId
 
-			for _, txId := range children {
-				deletable, err := tm.checkTransactionComplete(TransactionType(txType), txId)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				if deletable {
-					txPath := path + "/" + txId
-					if err := tm.client.DeleteRecursive(txPath); err != nil {
-						log.Printf("error in delete transaction %s: %v\n", txPath, err)
-					}
-				}
-			}
+		exists, err := tm.client.Exists(txPath)
+		if err != nil {
+			return "", fmt.Errorf("error in check transaction path %s: %v", txPath, err)
 		}
 
-		time.Sleep(interval)
+		if exists {
+			return txPath, nil
+		}
 	}
+
+	return "", ErrTransactionNotFound
 }
 
-func (tm *transactionManager) checkTransactionComplete(txType TransactionType, txId string) (bool, error) {
-	txPath := tm.basePath + "/" + string(txType) + "/" + txId
-	log.Printf("check transaction %s\n", txPath)
+func (tm *transactionManager) init() error {
+	log.Println("init transaction znodes")
+	if err := tm.client.CreateIfNotExists(tm.basePath, []byte{}); err != nil {
+		return err
+	}
 
-	exists, err := tm.client.Exists(txPath)
-	if err != nil {
-		return false, fmt.Errorf("error in check path: %v", err)
+	for _, txType := range TransactionTypes {
+		path := tm.basePath + "/" + string(txType)
+		if err := tm.client.CreateIfNotExists(path, []byte{}); err != nil {
+			return err
+		}
 	}
 
-	if !exists {
-		return false, fmt.Errorf("transaction not found")
+	if err := tm.client.CreateIfNotExists(tm.lockPath, []byte{}); err != nil {
+		return err
 	}
 
-	participants, err := tm.client.Children(txPath)
-	if err != nil {
-		return false, fmt.Errorf("error in list transaction %s %s participants: %v", txType, txPath, err)
+	if err := tm.client.CreateIfNotExists(tm.barrierPath, []byte{}); err != nil {
+		return err
 	}
 
-	for _, participant := range participants {
-		path := txPath + "/" + participant
-		data, err := tm.client.Get(path)
-		if err != nil {
-			return false, fmt.Errorf("error in get znode: %v", err)
-		}
+	if err := tm.client.CreateIfNotExists(tm.payloadPath, []byte{}); err != nil {
+		return err
+	}
 
-		if string(data) != string(StatusCommitted) && string(data) != string(StatusRolledBack) {
-			return false, nil
+	for _, path := range []string{"/coordinator", tm.electionPath} {
+		if err := tm.client.CreateIfNotExists(path, []byte{}); err != nil {
+			return err
 		}
 	}
 
-	return true, nil
+	if err := tm.client.CreateIfNotExists(tm.epochPath, []byte("0")); err != nil {
+		return err
+	}
+
+	if err := tm.client.CreateIfNotExists(tm.cleanupPath, []byte{}); err != nil {
+		return err
+	}
+
+	if err := tm.client.CreateIfNotExists(tm.auditPath, []byte{}); err != nil {
+		return err
+	}
+
+	if err := tm.client.CreateIfNotExists(tm.idempotencyPath, []byte{}); err != nil {
+		return err
+	}
+
+	log.Println("transaction znodes initialized")
+	return nil
 }
 
 func (tm *transactionManager) acquireExclusiveLock(resources []ResourceType) error {
@@ -351,7 +549,7 @@ func (tm *transactionManager) acquireExclusiveLock(resources []ResourceType) err
 	for i, resource := range resources {
 		path := tm.lockPath + "/" + string(resource)
 		for {
-			err := tm.client.CreateEmphemeral(path, []byte{})
+			err := tm.client.CreateLockNode(path, []byte{})
 			if err == nil {
 				break
 			}
@@ -389,6 +587,13 @@ func (tm *transactionManager) releaseExclusiveLock(resources []ResourceType) err
 	return nil
 }
 
+// releaseLock leaves a lock taken by another session after an expiry alone
 func (tm *transactionManager) releaseLock(nodePath string) error {
-	return tm.client.Delete(nodePath)
+	err := tm.client.DeleteOwned(nodePath)
+	if err == zkclient.ErrNotOwner || err == zk.ErrNoNode {
+		log.Printf("lock %s was lost with the session\n", nodePath)
+		return nil
+	}
+
+	return err
 }
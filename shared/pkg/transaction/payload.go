@@ -0,0 +1,67 @@
+package transaction
+
+import (
+	"fmt"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+)
+
+// DefaultChunkSize keeps the transaction znodes well below the 1MB znode limit
+const DefaultChunkSize = 512 * 1024
+
+// SetEncoding replaces the codec of the transaction znodes. Payloads larger
+// than chunkSize are split into chunk znodes under /transactions/payloads,
+// a zero chunkSize keeps every payload inline.
+func (tm *transactionManager) SetEncoding(codec Codec, chunkSize int) {
+	tm.codec = codec
+	tm.chunkSize = chunkSize
+}
+
+func (tm *transactionManager) encode(txData TransactionData) ([]byte, error) {
+	return encodeTransaction(tm.codec, txData)
+}
+
+func (tm *transactionManager) chunked(payload []byte) bool {
+	return tm.chunkSize > 0 && len(payload) > tm.chunkSize
+}
+
+func (tm *transactionManager) writePayload(txId string, payload []byte) error {
+	path := tm.payloadPath + "/" + txId
+	if err := tm.client.CreateIfNotExists(path, []byte{}); err != nil {
+		return fmt.Errorf("error in create transaction %s payload: %v", txId, err)
+	}
+
+	for i := 0; len(payload) > 0; i++ {
+		n := min(len(payload), tm.chunkSize)
+		if err := tm.client.Create(chunkPath(path, i), payload[:n]); err != nil {
+			return fmt.Errorf("error in create transaction %s payload chunk %d: %v", txId, i, err)
+		}
+		payload = payload[n:]
+	}
+
+	return nil
+}
+
+// readPayload joins the chunks of an offloaded payload back into txData
+func readPayload(client *zkclient.ZooKeeperClient, payloadPath string, txData *TransactionData) error {
+	if txData.PayloadChunks == 0 {
+		return nil
+	}
+
+	path := payloadPath + "/" + txData.Id
+	var payload []byte
+	for i := 0; i < txData.PayloadChunks; i++ {
+		data, err := client.Get(chunkPath(path, i))
+		if err != nil {
+			return fmt.Errorf("error in get transaction %s payload chunk %d: %v", txData.Id, i, err)
+		}
+		payload = append(payload, data...)
+	}
+	txData.Payload = payload
+
+	return nil
+}
+
+func chunkPath(path string, index int) string {
+	return fmt.Sprintf("%s/%06d", path, index)
+}
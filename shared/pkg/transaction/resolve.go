@@ -0,0 +1,185 @@
+package transaction
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+	"github.com/go-zookeeper/zk"
+)
+
+// Resolution is an operator decision. Without Heuristic the decision is
+// only written when the transaction is undecided, and a commit requires
+// every participant to have voted ready. A heuristic resolution overrides
+// an existing decision, the participants which already finished phase 2
+// keep their outcome.
+type Resolution struct {
+	Decision  TransactionStatus `json:"decision"`
+	Reason    string            `json:"reason"`
+	Operator  string            `json:"operator"`
+	Heuristic bool              `json:"heuristic"`
+}
+
+// AuditRecord is written under /coordinator/audit for every resolution
+type AuditRecord struct {
+	Resolution
+	TransactionId     string                       `json:"transaction_id"`
+	Type              TransactionType              `json:"type"`
+	Previous          TransactionStatus            `json:"previous"`
+	ParticipantStatus map[string]TransactionStatus `json:"participant_status"`
+	Coordinator       string                       `json:"coordinator"`
+	Epoch             int64                        `json:"epoch"`
+	ResolvedAt        time.Time                    `json:"resolved_at"`
+}
+
+func (tm *transactionManager) ResolveTransaction(txId string, resolution Resolution) (TransactionState, error) {
+	if resolution.Decision != StatusCommit && resolution.Decision != StatusRollBack {
+		return TransactionState{}, fmt.Errorf("invalid decision %s, expect %s or %s", resolution.Decision, StatusCommit, StatusRollBack)
+	}
+	if resolution.Operator == "" || resolution.Reason == "" {
+		return TransactionState{}, fmt.Errorf("operator and reason are required")
+	}
+
+	log.Printf("operator %s resolves transaction %s to %s: %s\n", resolution.Operator, txId, resolution.Decision, resolution.Reason)
+
+	txPath, err := tm.findTransaction(txId)
+	if err != nil {
+		return TransactionState{}, err
+	}
+
+	txData, previous, err := tm.resolveDecision(txPath, txId, resolution)
+	if err != nil {
+		return TransactionState{}, err
+	}
+
+	if resolution.Heuristic {
+		tm.overrideParticipants(txPath, txData)
+	}
+	if err := tm.driveParticipants(txPath, txData, unfenced); err != nil {
+		return TransactionState{}, err
+	}
+
+	state, err := tm.GetTransaction(txId)
+	if err != nil {
+		return TransactionState{}, err
+	}
+
+	// the decision is written already, a failed audit is still reported
+	err = tm.audit(AuditRecord{
+		Resolution:        resolution,
+		TransactionId:     txId,
+		Type:              state.Type,
+		Previous:          previous,
+		ParticipantStatus: state.ParticipantStatus,
+		Coordinator:       tm.id,
+		Epoch:             txData.Epoch,
+		ResolvedAt:        time.Now(),
+	})
+
+	return state, err
+}
+
+// resolveDecision writes the operator decision with a versioned update,
+// like decide, and returns the decision which was there before.
+func (tm *transactionManager) resolveDecision(txPath string, txId string, resolution Resolution) (TransactionData, TransactionStatus, error) {
+	for {
+		data, version, err := tm.client.GetWithVersion(txPath)
+		if err != nil {
+			return TransactionData{}, "", fmt.Errorf("error in get znode %s: %v", txPath, err)
+		}
+
+		txData, err := decodeTransaction(data)
+		if err != nil {
+			return TransactionData{}, "", fmt.Errorf("error in decode transaction %s: %v", txId, err)
+		}
+		txData.Id = txId
+		previous := txData.Status
+
+		if isDecided(previous) {
+			if isCommitted(previous) == (resolution.Decision == StatusCommit) {
+				// same decision, only drive the participants again
+				return txData, previous, nil
+			}
+			if !resolution.Heuristic {
+				return TransactionData{}, "", fmt.Errorf("%w: %s", ErrAlreadyDecided, previous)
+			}
+			log.Printf("heuristic override of transaction %s decision %s\n", txId, previous)
+		} else if resolution.Decision == StatusCommit && !resolution.Heuristic {
+			ready, err := tm.collectVotes(txPath, txData)
+			if err != nil {
+				return TransactionData{}, "", err
+			}
+			if !ready {
+				return TransactionData{}, "", ErrNotReady
+			}
+		}
+
+		epoch, epochVersion, err := tm.currentEpoch()
+		if err != nil {
+			return TransactionData{}, "", err
+		}
+		txData.Status = resolution.Decision
+		txData.Coordinator = tm.id
+		txData.Epoch = epoch
+
+		data, err = tm.encode(txData)
+		if err != nil {
+			return TransactionData{}, "", err
+		}
+
+		log.Printf("write %s status to %s at epoch %d\n", txId, resolution.Decision, epoch)
+		if err := tm.client.SetWithVersionFenced(txPath, data, version, tm.epochPath, epochVersion); err != nil {
+			if err == zk.ErrBadVersion || err == zkclient.ErrFenced {
+				continue
+			}
+			return TransactionData{}, "", fmt.Errorf("error in set znode %s value: %v", txPath, err)
+		}
+
+		return txData, previous, nil
+	}
+}
+
+// overrideParticipants replaces the overridden decision of the participants
+// which have not applied it yet, the finished ones cannot be changed.
+func (tm *transactionManager) overrideParticipants(txPath string, txData TransactionData) {
+	value, overridden := StatusRollBack, StatusCommit
+	if isCommitted(txData.Status) {
+		value, overridden = StatusCommit, StatusRollBack
+	}
+
+	for _, participant := range txData.Participants {
+		path := txPath + "/" + participant
+		data, version, err := tm.client.GetWithVersion(path)
+		if err != nil {
+			log.Printf("error in get znode %s: %v\n", path, err)
+			continue
+		}
+
+		switch TransactionStatus(data) {
+		case overridden:
+			log.Printf("write %s/%s status to %s\n", txData.Id, participant, value)
+			if err := tm.client.SetWithVersion(path, []byte(value), version); err != nil {
+				log.Printf("error in set znode %s value: %v\n", path, err)
+			}
+		case StatusCommitted, StatusRolledBack:
+			if isCommitted(TransactionStatus(data)) != isCommitted(value) {
+				log.Printf("heuristic hazard, transaction %s/%s already %s\n", txData.Id, participant, data)
+			}
+		}
+	}
+}
+
+func (tm *transactionManager) audit(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error in marshal audit record: %v", err)
+	}
+
+	if _, err := tm.client.CreateSequential(tm.auditPath+"/", data); err != nil {
+		return fmt.Errorf("error in write audit record of transaction %s: %v", record.TransactionId, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package transaction
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy decides when transactions are archived and removed from
+// ZooKeeper. Completed transactions, decided and acknowledged by every
+// participant, are removed once they are older than MaxAge, or when a type
+// holds more than MaxCount of them. Statuses limits the removal to the
+// listed decisions, an empty list allows all of them. Transactions which
+// never complete are reported as stale after StaleAge, and only removed
+// when an operator sets PurgeStale: a participant which comes back later
+// would find no decision for its prepared transaction.
+type RetentionPolicy struct {
+	MaxAge     time.Duration
+	MaxCount   int
+	Statuses   []TransactionStatus
+	StaleAge   time.Duration
+	PurgeStale bool
+}
+
+var DefaultRetentionPolicy = RetentionPolicy{
+	StaleAge: 24 * time.Hour,
+}
+
+type CleanupStats struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Scanned   int           `json:"scanned"`
+	Pending   int           `json:"pending"`
+	Kept      int           `json:"kept"`
+	Archived  int           `json:"archived"`
+	Deleted   int           `json:"deleted"`
+	Stale     int           `json:"stale"`
+	Failed    int           `json:"failed"`
+}
+
+func (p RetentionPolicy) removable(status TransactionStatus) bool {
+	if len(p.Statuses) == 0 {
+		return true
+	}
+
+	for _, s := range p.Statuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetRetention replaces the retention policy, a nil archiver deletes the
+// transactions without keeping any history.
+func (tm *transactionManager) SetRetention(policy RetentionPolicy, archiver Archiver) {
+	tm.retention = policy
+	tm.archiver = archiver
+}
+
+func (tm *transactionManager) clean() {
+	stats := CleanupStats{StartedAt: time.Now()}
+
+	for _, txType := range TransactionTypes {
+		path := tm.basePath + "/" + string(txType)
+		children, ok := tm.cache.Children(path)
+		if !ok {
+			continue
+		}
+
+		var completed []TransactionState
+		for _, txId := range children {
+			stats.Scanned++
+
+			state, err := tm.loadState(txType, txId)
+			if err != nil {
+				log.Println(err)
+				stats.Failed++
+				continue
+			}
+
+			if state.Completed && state.Decided() {
+				completed = append(completed, state)
+				continue
+			}
+
+			if tm.retention.StaleAge > 0 && time.Since(state.Timestamp) > tm.retention.StaleAge {
+				log.Printf("transaction %s/%s never completed: %s %v\n", txType, txId, state.Status, state.ParticipantStatus)
+				stats.Stale++
+				if tm.retention.PurgeStale {
+					tm.remove(path+"/"+txId, state, &stats)
+					continue
+				}
+			}
+
+			stats.Pending++
+		}
+
+		// oldest first, so the count limit removes the oldest transactions
+		sort.Slice(completed, func(i, j int) bool {
+			return completed[i].Timestamp.Before(completed[j].Timestamp)
+		})
+
+		for i, state := range completed {
+			overflow := tm.retention.MaxCount > 0 && len(completed)-i > tm.retention.MaxCount
+			aged := time.Since(state.Timestamp) >= tm.retention.MaxAge
+			if !tm.retention.removable(state.Status) || (!aged && !overflow) {
+				stats.Kept++
+				continue
+			}
+
+			tm.remove(path+"/"+state.Id, state, &stats)
+		}
+	}
+
+	stats.Duration = time.Since(stats.StartedAt)
+	tm.reportCleanup(stats)
+}
+
+// remove archives the transaction first, it is never deleted without history
+func (tm *transactionManager) remove(txPath string, state TransactionState, stats *CleanupStats) {
+	// a key still claimed without the id would not find the transaction
+	if state.IdempotencyKey != "" {
+		if err := tm.recordIdempotentTransaction(state.IdempotencyKey, state.Id); err != nil {
+			log.Println(err)
+			stats.Failed++
+			return
+		}
+	}
+
+	record := ArchiveRecord{TransactionState: state}
+	if tm.archiver != nil {
+		// the history keeps the whole payload, the chunks are removed below
+		if err := readPayload(tm.client, tm.payloadPath, &record.TransactionData); err != nil {
+			log.Printf("error in read transaction %s payload: %v\n", txPath, err)
+			stats.Failed++
+			return
+		}
+
+		record.ArchivedAt = time.Now()
+		if err := tm.archiver.Archive(record); err != nil {
+			log.Printf("error in archive transaction %s: %v\n", txPath, err)
+			stats.Failed++
+			return
+		}
+		stats.Archived++
+	}
+
+	if err := tm.client.DeleteRecursive(txPath); err != nil {
+		log.Printf("error in delete transaction %s: %v\n", txPath, err)
+		stats.Failed++
+		return
+	}
+	stats.Deleted++
+
+	if err := tm.client.DeleteRecursive(tm.barrierPath + "/" + record.Id); err != nil {
+		log.Printf("error in delete transaction %s barriers: %v\n", record.Id, err)
+	}
+
+	if record.PayloadChunks > 0 {
+		if err := tm.client.DeleteRecursive(tm.payloadPath + "/" + record.Id); err != nil {
+			log.Printf("error in delete transaction %s payload: %v\n", record.Id, err)
+		}
+	}
+}
+
+func (tm *transactionManager) reportCleanup(stats CleanupStats) {
+	log.Printf("cleanup finished in %s: scanned %d, pending %d, kept %d, archived %d, deleted %d, stale %d, failed %d\n",
+		stats.Duration, stats.Scanned, stats.Pending, stats.Kept, stats.Archived, stats.Deleted, stats.Stale, stats.Failed)
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		log.Printf("error in marshal cleanup stats: %v\n", err)
+		return
+	}
+
+	if err := tm.client.Set(tm.cleanupPath, data); err != nil {
+		log.Printf("error in write cleanup stats: %v\n", err)
+	}
+}
+
+// loadState reads the cached transaction with its participants
+func (tm *transactionManager) loadState(txType TransactionType, txId string) (TransactionState, error) {
+	txPath := tm.basePath + "/" + string(txType) + "/" + txId
+	return readState(tm.cache.Get, txPath, txType, txId)
+}
@@ -0,0 +1,56 @@
+package transaction
+
+import (
+	"log"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+)
+
+// watchSession aborts the in-flight transactions once the session expired.
+// Our election znode was gone, so the leader may already treat them as
+// orphaned, the versioned decision keeps both sides consistent.
+func (tm *transactionManager) watchSession(events <-chan zkclient.SessionEvent) {
+	for event := range events {
+		if event.State != zkclient.SessionRestored {
+			continue
+		}
+
+		tm.mu.Lock()
+		inflight := make(map[string]string, len(tm.inflight))
+		for txId, txPath := range tm.inflight {
+			inflight[txId] = txPath
+		}
+		tm.mu.Unlock()
+
+		for txId, txPath := range inflight {
+			log.Printf("abort in-flight transaction %s after session expiry\n", txId)
+			txData, err := tm.decide(txPath, txId, false, unfenced)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			if err := tm.driveParticipants(txPath, txData, unfenced); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// watchSession wakes up every transaction type loop to re-verify its
+// transactions against the new session, or once a barrier membership was
+// lost with the old one.
+func (tw *transactionWatcher) watchSession(events <-chan zkclient.SessionEvent) {
+	for event := range events {
+		if event.State == zkclient.SessionEphemeralLost {
+			log.Printf("ephemeral znode %s lost with the session\n", event.Path)
+		} else if event.State != zkclient.SessionRestored {
+			continue
+		}
+
+		tw.mu.Lock()
+		close(tw.resync)
+		tw.resync = make(chan struct{})
+		tw.mu.Unlock()
+	}
+}
@@ -0,0 +1,60 @@
+package transaction
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	shardMu sync.RWMutex
+	shards  = make(map[string][]string)
+)
+
+// SetShards splits a participant into the services of the list, every key
+// belongs to one of them. The list must keep its order, a key moves to
+// another shard when a shard is added or removed.
+func SetShards(participant string, names []string) {
+	shardMu.Lock()
+	defer shardMu.Unlock()
+
+	if len(names) <= 1 {
+		delete(shards, participant)
+		return
+	}
+	shards[participant] = names
+}
+
+// LoadShards reads the comma separated shards of a participant from the
+// <PARTICIPANT>_SHARDS environment variable, e.g. USER_SHARDS=user,user-2
+func LoadShards(participant string) []string {
+	names := []string{participant}
+	if value, ok := syscall.Getenv(strings.ToUpper(participant) + "_SHARDS"); ok && value != "" {
+		names = names[:0]
+		for _, name := range strings.Split(value, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+
+	SetShards(participant, names)
+
+	return names
+}
+
+// ShardFor returns the shard of the participant which owns the key, a
+// participant which is not sharded owns every key
+func ShardFor(participant string, key string) string {
+	shardMu.RLock()
+	defer shardMu.RUnlock()
+
+	names, ok := shards[participant]
+	if !ok {
+		return participant
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return names[h.Sum32()%uint32(len(names))]
+}
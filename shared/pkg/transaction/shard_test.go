@@ -0,0 +1,78 @@
+package transaction
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// keysOnShards returns a key owned by every shard of the participant
+func keysOnShards(t *testing.T, participant string, names []string) map[string]string {
+	keys := make(map[string]string, len(names))
+	for i := 0; len(keys) < len(names) && i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if shard := ShardFor(participant, key); keys[shard] == "" {
+			keys[shard] = key
+		}
+	}
+	if len(keys) < len(names) {
+		t.Fatalf("no key found for every shard of %v", names)
+	}
+
+	return keys
+}
+
+func TestShardFor(t *testing.T) {
+	SetShards("test", nil)
+	if got := ShardFor("test", "key"); got != "test" {
+		t.Errorf("ShardFor() of an unsharded participant = %s, want test", got)
+	}
+
+	names := []string{"test", "test-2", "test-3"}
+	SetShards("test", names)
+	defer SetShards("test", nil)
+
+	keys := keysOnShards(t, "test", names)
+	for shard, key := range keys {
+		if got := ShardFor("test", key); got != shard {
+			t.Errorf("ShardFor(%s) = %s, want %s", key, got, shard)
+		}
+	}
+}
+
+func TestParticipantsFor(t *testing.T) {
+	SetShards("test", []string{"test", "test-2"})
+	defer SetShards("test", nil)
+	keys := keysOnShards(t, "test", []string{"test", "test-2"})
+
+	spec := TransactionSpec{
+		Participants: []string{"order", "test"},
+		Resources:    []ResourceType{OrderResource, UserResource, PayeeResource},
+		ShardedBy:    map[ResourceType]string{UserResource: "test", PayeeResource: "test"},
+	}
+
+	tests := []struct {
+		name      string
+		resources map[ResourceType]string
+		want      []string
+	}{
+		{
+			name:      "same shard",
+			resources: map[ResourceType]string{UserResource: keys["test-2"], PayeeResource: keys["test-2"]},
+			want:      []string{"order", "test-2"},
+		},
+		{
+			name:      "two shards",
+			resources: map[ResourceType]string{UserResource: keys["test-2"], PayeeResource: keys["test"]},
+			want:      []string{"order", "test-2", "test"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := spec.ParticipantsFor(tt.resources); !slices.Equal(got, tt.want) {
+				t.Errorf("ParticipantsFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
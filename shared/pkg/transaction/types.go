@@ -1,16 +1,24 @@
 package transaction
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 type ResourceType string
 type TransactionType string
 type TransactionStatus string
 
 const (
-	OrderCreation TransactionType = "ORDER_CREATION"
+	OrderCreation     TransactionType = "ORDER_CREATION"
+	OrderCancellation TransactionType = "ORDER_CANCELLATION"
+	WalletTopUp       TransactionType = "WALLET_TOPUP"
+	WalletTransfer    TransactionType = "WALLET_TRANSFER"
 
-	OrderResource ResourceType = "ORDER_RESOURCE"
-	UserResource  ResourceType = "USER_RESOURCE"
+	OrderResource     ResourceType = "ORDER_RESOURCE"
+	UserResource      ResourceType = "USER_RESOURCE"
+	InventoryResource ResourceType = "INVENTORY_RESOURCE"
+	PayeeResource     ResourceType = "PAYEE_RESOURCE"
 )
 
 const (
@@ -24,23 +32,172 @@ const (
 	StatusRolledBack TransactionStatus = "ROLLED_BACK"
 )
 
+// a transaction is decided once the coordinator wrote commit or roll back
+func isDecided(status TransactionStatus) bool {
+	switch status {
+	case StatusCommit, StatusCommitted, StatusRollBack, StatusRolledBack:
+		return true
+	}
+	return false
+}
+
+func isCommitted(status TransactionStatus) bool {
+	return status == StatusCommit || status == StatusCommitted
+}
+
+var (
+	ErrTransactionNotFound = errors.New("transaction id not found")
+	ErrAlreadyDecided      = errors.New("transaction already decided")
+	ErrNotReady            = errors.New("transaction participants not ready")
+	ErrIdempotencyConflict = errors.New("idempotency key reused for another request")
+	ErrNotLeader           = errors.New("leader epoch changed")
+)
+
 var (
 	TransactionTypes []TransactionType = []TransactionType{
 		OrderCreation,
+		OrderCancellation,
+		WalletTopUp,
+		WalletTransfer,
 	}
 	ResourceTypes []ResourceType = []ResourceType{
 		OrderResource,
 		UserResource,
+		InventoryResource,
+		PayeeResource,
+	}
+	TransactionRegistry map[TransactionType]TransactionSpec = map[TransactionType]TransactionSpec{
+		OrderCreation: {
+			Participants: []string{"order", "user", "inventory"},
+			Resources:    []ResourceType{OrderResource, UserResource, InventoryResource},
+			ShardedBy:    map[ResourceType]string{UserResource: "user"},
+			Policy:       TransactionPolicy{Timeout: 30 * time.Second},
+		},
+		OrderCancellation: {
+			Participants: []string{"order", "user", "inventory"},
+			Resources:    []ResourceType{OrderResource, UserResource, InventoryResource},
+			ShardedBy:    map[ResourceType]string{UserResource: "user"},
+			Policy:       TransactionPolicy{Timeout: 30 * time.Second},
+		},
+		WalletTopUp: {
+			Participants: []string{"user"},
+			Resources:    []ResourceType{UserResource},
+			ShardedBy:    map[ResourceType]string{UserResource: "user"},
+			Policy:       TransactionPolicy{Timeout: 30 * time.Second},
+		},
+		// the payer and the payee may live on different user shards, each
+		// shard takes part with the holds of its own wallet
+		WalletTransfer: {
+			Participants: []string{"user"},
+			Resources:    []ResourceType{UserResource, PayeeResource},
+			ShardedBy:    map[ResourceType]string{UserResource: "user", PayeeResource: "user"},
+			Policy:       TransactionPolicy{Timeout: 30 * time.Second},
+		},
 	}
 )
 
+// TransactionSpec describes a transaction type, the coordinator executes a
+// transaction with the participants and the resources of its type.
+// ShardedBy names the participant whose shard owns the key of a resource.
+type TransactionSpec struct {
+	Participants []string
+	Resources    []ResourceType
+	ShardedBy    map[ResourceType]string
+	Policy       TransactionPolicy
+}
+
+// ParticipantsFor replaces every sharded participant with the shards which
+// own the keys of its resources, e.g. a transfer between two user shards
+// has both of them as participants
+func (spec TransactionSpec) ParticipantsFor(resources map[ResourceType]string) []string {
+	var participants []string
+	seen := make(map[string]bool)
+	add := func(participant string) {
+		if !seen[participant] {
+			seen[participant] = true
+			participants = append(participants, participant)
+		}
+	}
+
+	for _, participant := range spec.Participants {
+		sharded := false
+		for _, resource := range spec.Resources {
+			if spec.ShardedBy[resource] == participant {
+				sharded = true
+				add(ShardFor(participant, resources[resource]))
+			}
+		}
+		if !sharded {
+			add(participant)
+		}
+	}
+
+	return participants
+}
+
+// RegisterTransactionType adds a transaction type to the registry. The
+// coordinator and the participants must register it before they start.
+func RegisterTransactionType(txType TransactionType, spec TransactionSpec) {
+	if _, ok := TransactionRegistry[txType]; !ok {
+		TransactionTypes = append(TransactionTypes, txType)
+	}
+	TransactionRegistry[txType] = spec
+}
+
+func LookupTransactionType(txType TransactionType) (TransactionSpec, bool) {
+	spec, ok := TransactionRegistry[txType]
+	return spec, ok
+}
+
+// Coordinator is the replica which owns the transaction, and Epoch is the
+// leader epoch at the time the decision was written. A transaction which is
+// still undecided after its Deadline is aborted. A large payload is stored
+// in PayloadChunks chunk znodes instead of the transaction znode. Resources
+// maps every resource of the transaction to the key it works on, e.g. the
+// user id of USER_RESOURCE.
 type TransactionData struct {
-	Id           string            `json:"id"`
-	Type         TransactionType   `json:"type"`
-	Timestamp    time.Time         `json:"timestamp"`
-	Payload      []byte            `json:"payload"`
-	Status       TransactionStatus `json:"status"`
-	Participants []string          `json:"participants"`
+	Id             string                  `json:"id"`
+	Type           TransactionType         `json:"type"`
+	Timestamp      time.Time               `json:"timestamp"`
+	Deadline       time.Time               `json:"deadline"`
+	Payload        []byte                  `json:"payload"`
+	Status         TransactionStatus       `json:"status"`
+	Participants   []string                `json:"participants"`
+	Coordinator    string                  `json:"coordinator"`
+	Epoch          int64                   `json:"epoch"`
+	Resources      map[ResourceType]string `json:"resources,omitempty"`
+	Version        int                     `json:"version"`
+	PayloadChunks  int                     `json:"payload_chunks,omitempty"`
+	IdempotencyKey string                  `json:"idempotency_key,omitempty"`
+}
+
+// Decided reports whether the coordinator wrote commit or roll back
+func (d TransactionData) Decided() bool {
+	return isDecided(d.Status)
+}
+
+func (d TransactionData) Committed() bool {
+	return isCommitted(d.Status)
+}
+
+// Expired reports whether the transaction is still undecided after its deadline.
+func (d TransactionData) Expired() bool {
+	return !d.Deadline.IsZero() && time.Now().After(d.Deadline) && !isDecided(d.Status)
+}
+
+type TransactionPolicy struct {
+	// Timeout is used as the deadline when the request carries none
+	Timeout time.Duration
+}
+
+// VoteResult is the outcome of phase 1 with the last vote seen from every
+// participant, a participant which did not vote keeps its INIT or PREPARED
+// state. Reasons holds why the participants which did not vote READY
+// aborted.
+type VoteResult struct {
+	Commit  bool
+	Votes   map[string]TransactionStatus
+	Reasons map[string]AbortReason
 }
 
 type TransactionHandler func(txData TransactionData) error
@@ -49,13 +206,33 @@ type TransactionFinalizeHandler func(txId string) error
 type TransactionWatcher interface {
 	RegisterHandler(TransactionType, TransactionHandler, TransactionFinalizeHandler)
 	GetBasePath() string
+	EnterPrepare(txData TransactionData, participant string) (bool, error)
+	LeavePrepare(txData TransactionData, participant string)
+	VoteAbort(txData TransactionData, participant string, reason AbortReason) error
+	WaitDecision(txId string) error
 	Watch()
 	Stop()
 }
 
+// TransactionInspector reads the transactions from the /transactions tree
+type TransactionInspector interface {
+	GetTransaction(txId string) (TransactionState, error)
+	ListTransactions(query TransactionQuery) ([]TransactionState, error)
+	WatchTransaction(txId string, stop <-chan struct{}) (<-chan TransactionState, error)
+}
+
+// TransactionResolver lets an operator decide a transaction stuck in doubt
+type TransactionResolver interface {
+	ResolveTransaction(txId string, resolution Resolution) (TransactionState, error)
+}
+
 type TransactionManager interface {
-	Begin(txType TransactionType, data []byte, participants []string, resources []ResourceType) (string, error)
+	TransactionInspector
+	Begin(txType TransactionType, data []byte, participants []string, resources map[ResourceType]string, deadline time.Time) (string, error)
+	BeginOnce(key string, txType TransactionType, data []byte, participants []string, resources map[ResourceType]string, deadline time.Time) (string, bool, error)
 	Prepare(txId string) error
-	Finalize(txId string, isCommit bool) error
-	GetVotesResult(txId string) (bool, error)
+	Finalize(txId string, isCommit bool) (bool, error)
+	GetVotesResult(txId string) (VoteResult, error)
+	Run()
+	Stop()
 }
@@ -0,0 +1,99 @@
+package transaction
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
+	"github.com/go-zookeeper/zk"
+)
+
+// AbortReason explains an abort vote, Code is machine readable and Message
+// is meant for the client.
+type AbortReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	ReasonInsufficientFunds = "INSUFFICIENT_FUNDS"
+	ReasonUserNotFound      = "USER_NOT_FOUND"
+	ReasonOutOfStock        = "OUT_OF_STOCK"
+	ReasonUnknownSku        = "UNKNOWN_SKU"
+	ReasonOrderNotFound     = "ORDER_NOT_FOUND"
+	ReasonOrderNotOwned     = "ORDER_NOT_OWNED"
+	ReasonOrderCancelled    = "ORDER_ALREADY_CANCELLED"
+	ReasonOrderNotConfirmed = "ORDER_NOT_CONFIRMED"
+	ReasonCurrencyMismatch  = "CURRENCY_MISMATCH"
+	ReasonAmountOverflow    = "AMOUNT_OVERFLOW"
+	ReasonExpired           = "EXPIRED"
+	ReasonVoteTimeout       = "VOTE_TIMEOUT"
+	ReasonInternal          = "INTERNAL"
+)
+
+// the reason is a child of the participant znode, written before the vote
+const reasonNode = "reason"
+
+// VoteAbort votes abort with a reason. Like every abort vote it only
+// replaces a vote which has not been cast yet.
+func (tw *transactionWatcher) VoteAbort(txData TransactionData, participant string, reason AbortReason) error {
+	path := tw.basePath + "/" + string(txData.Type) + "/" + txData.Id + "/" + participant
+	return tw.voteAbort(path, reason)
+}
+
+func (tw *transactionWatcher) voteAbort(path string, reason AbortReason) error {
+	data, version, err := tw.client.GetWithVersion(path)
+	if err != nil {
+		return fmt.Errorf("error in get znode %s: %v", path, err)
+	}
+
+	if string(data) != string(StatusInit) && string(data) != string(StatusPrepared) {
+		return nil
+	}
+
+	log.Printf("vote abort %s: %s %s\n", path, reason.Code, reason.Message)
+	if err := writeReason(tw.client, path, reason); err != nil {
+		log.Println(err)
+	}
+
+	if err := tw.client.SetWithVersion(path, []byte(StatusAbort), version); err != nil {
+		return fmt.Errorf("error in set znode %s value: %v", path, err)
+	}
+
+	return nil
+}
+
+func writeReason(client *zkclient.ZooKeeperClient, path string, reason AbortReason) error {
+	data, err := json.Marshal(reason)
+	if err != nil {
+		return fmt.Errorf("error in marshal abort reason: %v", err)
+	}
+
+	err = client.Create(path+"/"+reasonNode, data)
+	if err == zk.ErrNodeExists {
+		err = client.Set(path+"/"+reasonNode, data)
+	}
+	if err != nil {
+		return fmt.Errorf("error in write abort reason of %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// readReason returns the reason of an abort vote, votes written without a
+// reason read as INTERNAL.
+func readReason(client *zkclient.ZooKeeperClient, path string) AbortReason {
+	data, err := client.Get(path + "/" + reasonNode)
+	if err != nil {
+		return AbortReason{Code: ReasonInternal, Message: "participant aborted"}
+	}
+
+	var reason AbortReason
+	if err := json.Unmarshal(data, &reason); err != nil {
+		log.Printf("error in unmarshal abort reason of %s: %v\n", path, err)
+		return AbortReason{Code: ReasonInternal, Message: "participant aborted"}
+	}
+
+	return reason
+}
@@ -1,10 +1,10 @@
 package transaction
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"sort"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,27 +13,39 @@ import (
 
 type transactionWatcher struct {
 	client           *zkclient.ZooKeeperClient
+	participant      string
 	basePath         string
+	barrierPath      string
+	payloadPath      string
 	handlers         map[TransactionType]TransactionHandler
 	finalizeHandlers map[TransactionType]TransactionFinalizeHandler
 	stopChan         chan struct{}
+	resync           chan struct{}
 	mu               sync.RWMutex
 	wg               sync.WaitGroup
 }
 
-func NewTransactionWatcher(client *zkclient.ZooKeeperClient) (*transactionWatcher, error) {
+// NewTransactionWatcher runs the handlers for the transactions which list
+// the participant, e.g. only those of its own shard
+func NewTransactionWatcher(client *zkclient.ZooKeeperClient, participant string) (*transactionWatcher, error) {
 	tw := &transactionWatcher{
 		client:           client,
+		participant:      participant,
 		basePath:         "/transactions",
+		barrierPath:      "/transactions/barriers",
+		payloadPath:      "/transactions/payloads",
 		handlers:         make(map[TransactionType]TransactionHandler),
 		finalizeHandlers: make(map[TransactionType]TransactionFinalizeHandler),
 		stopChan:         make(chan struct{}),
+		resync:           make(chan struct{}),
 	}
 
 	if err := tw.init(); err != nil {
 		return nil, err
 	}
 
+	go tw.watchSession(client.Subscribe())
+
 	return tw, nil
 }
 
@@ -100,71 +112,126 @@ func (tw *transactionWatcher) init() error {
 	return nil
 }
 
+// watchTransaction keeps one persistent recursive watch per transaction
+// type. A new subscription is taken after the session was restored, so the
+// known transactions are verified again.
 func (tw *transactionWatcher) watchTransaction(txType TransactionType) {
 	log.Println("watch transaction", txType)
 
 	defer tw.wg.Done()
+	path := tw.basePath + "/" + string(txType)
 	for {
 		select {
 		case <-tw.stopChan:
 			return
 		default:
-			path := tw.basePath + "/" + string(txType)
-			children, ch, err := tw.client.ChildrenW(path)
+		}
+
+		tw.mu.RLock()
+		resync := tw.resync
+		tw.mu.RUnlock()
+
+		sub, err := tw.client.AddWatch(path, zkclient.AddWatchModePersistentRecursive)
+		if err != nil {
+			log.Printf("watch %s transactions failed: %v\n", txType, err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		tw.consume(txType, sub, resync)
+		sub.Close()
+	}
+}
+
+// consume processes the existing transactions first, then the transaction
+// znode changes, one transaction at a time.
+func (tw *transactionWatcher) consume(txType TransactionType, sub *zkclient.Subscription, resync <-chan struct{}) {
+	path := tw.basePath + "/" + string(txType)
+	processed := make(map[string]bool)
+
+	process := func(txId string) {
+		if processed[txId] {
+			return
+		}
+
+		for {
+			done, err := tw.processTransaction(txType, txId, sub)
 			if err != nil {
-				log.Printf("watch %s children failed: %v\n", txType, err)
+				log.Printf("process %s transaction failed: %v\n", txType, err)
+				time.Sleep(time.Second)
 				continue
 			}
-			sort.Strings(children)
+			processed[txId] = done
+			return
+		}
+	}
 
-			// execute the transactions serializely
-			for _, txId := range children {
-				for {
-					if err := tw.processTransaction(txType, txId); err != nil {
-						log.Printf("process %s transaction failed: %v\n", txType, err)
-						time.Sleep(time.Second)
-						continue
-					}
-					break
-				}
-			}
+	// execute the transactions serializely
+	children, _ := sub.Children(path)
+	for _, txId := range children {
+		process(txId)
+	}
 
-			select {
-			case <-tw.stopChan:
+	for {
+		select {
+		case <-tw.stopChan:
+			return
+		case <-resync:
+			log.Printf("re-verify %s transactions\n", txType)
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
 				return
-			case <-ch:
 			}
+
+			// the participant znodes are written by the participants themselves
+			txId := strings.TrimPrefix(event.Path, path+"/")
+			if txId == event.Path || strings.Contains(txId, "/") {
+				continue
+			}
+
+			if event.Type == zkclient.NodeRemoved {
+				delete(processed, txId)
+				continue
+			}
+			process(txId)
 		}
 	}
 }
 
-func (tw *transactionWatcher) processTransaction(txType TransactionType, txId string) error {
+// processTransaction runs the handlers once the transaction is prepared or
+// decided, and reports whether the transaction is done for this participant.
+func (tw *transactionWatcher) processTransaction(txType TransactionType, txId string, sub *zkclient.Subscription) (bool, error) {
 	log.Printf("process transaction %s/%s\n", txType, txId)
 	path := tw.basePath + "/" + string(txType) + "/" + txId
 
-	var txData TransactionData
-	for {
-		data, ch, err := tw.client.GetW(path)
-		if err != nil {
-			return fmt.Errorf("error getting transaction %s %s data: %v", txType, txId, err)
-		}
+	data, ok := sub.Get(path)
+	if !ok {
+		return true, nil
+	}
 
-		// unmarshal txData
-		if err := json.Unmarshal(data, &txData); err != nil {
-			return fmt.Errorf("error unmarshaling transaction data: %v", err)
-		}
-		txData.Id = txId
+	txData, err := decodeTransaction(data)
+	if err != nil {
+		return false, err
+	}
+	txData.Id = txId
 
-		if txData.Status == StatusPrepared || txData.Status == StatusRollBack || txData.Status == StatusCommit {
-			break
-		}
+	if !slices.Contains(txData.Participants, tw.participant) {
+		return true, nil
+	}
 
-		if txData.Status == StatusCommitted || txData.Status == StatusRolledBack {
-			log.Printf("transaction %s/%s completed: %s\n", txType, txId, txData.Status)
-			return nil
-		}
+	if txData.Status == StatusCommitted || txData.Status == StatusRolledBack {
+		log.Printf("transaction %s/%s completed: %s\n", txType, txId, txData.Status)
+		return true, nil
+	}
 
-		<-ch
+	// wait for the next change of the transaction znode
+	if txData.Status != StatusPrepared && txData.Status != StatusRollBack && txData.Status != StatusCommit {
+		return false, nil
+	}
+
+	if err := readPayload(tw.client, tw.payloadPath, &txData); err != nil {
+		return false, err
 	}
 
 	// get handler and execute
@@ -174,16 +241,16 @@ func (tw *transactionWatcher) processTransaction(txType TransactionType, txId st
 	tw.mu.RUnlock()
 
 	if !handlerExists || !finalizeHandlerExists {
-		return fmt.Errorf("%s handler not exists", txType)
+		return false, fmt.Errorf("%s handler not exists", txType)
 	}
 
 	if err := handler(txData); err != nil {
-		return err
+		return false, err
 	}
 
 	if err := finalizeHandler(txId); err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return true, nil
 }
@@ -0,0 +1,185 @@
+package zkclient
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// Barrier implements the ZooKeeper barrier recipe, the clients wait while
+// the barrier znode exists and go on together once it is removed.
+type Barrier struct {
+	client *ZooKeeperClient
+	path   string
+}
+
+func NewBarrier(client *ZooKeeperClient, path string) *Barrier {
+	return &Barrier{client: client, path: path}
+}
+
+func (b *Barrier) Set() error {
+	return b.client.CreateIfNotExists(b.path, []byte{})
+}
+
+func (b *Barrier) Remove() error {
+	err := b.client.Delete(b.path)
+	if err != nil && err != zk.ErrNoNode {
+		return err
+	}
+
+	return nil
+}
+
+// Wait blocks until the barrier is removed or the context is done
+func (b *Barrier) Wait(ctx context.Context) error {
+	for {
+		exists, ch, err := b.client.ExistsW(b.path)
+		if err != nil {
+			return fmt.Errorf("error in watch barrier %s: %v", b.path, err)
+		}
+
+		if !exists {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+// DoubleBarrier implements the ZooKeeper double barrier recipe, the
+// computation starts once size clients entered the barrier and finishes
+// once all of them left it.
+type DoubleBarrier struct {
+	client *ZooKeeperClient
+	path   string
+	name   string
+	size   int
+}
+
+const readyNode = "ready"
+
+func NewDoubleBarrier(client *ZooKeeperClient, path string, name string, size int) *DoubleBarrier {
+	return &DoubleBarrier{
+		client: client,
+		path:   path,
+		name:   name,
+		size:   size,
+	}
+}
+
+func (b *DoubleBarrier) Enter(ctx context.Context) error {
+	if err := b.client.CreateIfNotExists(b.path, []byte{}); err != nil {
+		return fmt.Errorf("error in create double barrier %s: %v", b.path, err)
+	}
+
+	node := b.path + "/" + b.name
+	if err := b.client.CreateEmphemeral(node, []byte{}); err != nil && err != zk.ErrNodeExists {
+		return fmt.Errorf("error in enter double barrier %s: %v", b.path, err)
+	}
+
+	for {
+		// watch the ready znode before counting, so its creation is not missed
+		ready, ch, err := b.client.ExistsW(b.path + "/" + readyNode)
+		if err != nil {
+			return fmt.Errorf("error in watch double barrier %s: %v", b.path, err)
+		}
+		if ready {
+			return nil
+		}
+
+		members, err := b.members()
+		if err != nil {
+			return err
+		}
+
+		if len(members) >= b.size {
+			if err := b.client.CreateIfNotExists(b.path+"/"+readyNode, []byte{}); err != nil {
+				return fmt.Errorf("error in create double barrier %s ready: %v", b.path, err)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			b.delete(node)
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+func (b *DoubleBarrier) Leave(ctx context.Context) error {
+	node := b.path + "/" + b.name
+
+	for {
+		members, err := b.members()
+		if err != nil {
+			if err == zk.ErrNoNode {
+				return nil
+			}
+			return err
+		}
+
+		if len(members) == 0 {
+			return nil
+		}
+
+		// the lowest member leaves last, everyone else waits for it
+		var watched string
+		switch {
+		case len(members) == 1 && members[0] == b.name:
+			b.delete(node)
+			return nil
+		case members[0] == b.name:
+			watched = members[len(members)-1]
+		default:
+			b.delete(node)
+			watched = members[0]
+		}
+
+		exists, ch, err := b.client.ExistsW(b.path + "/" + watched)
+		if err != nil {
+			return fmt.Errorf("error in watch double barrier %s: %v", b.path, err)
+		}
+		if !exists {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			b.delete(node)
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+func (b *DoubleBarrier) members() ([]string, error) {
+	children, err := b.client.Children(b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(children))
+	for _, child := range children {
+		if child != readyNode {
+			members = append(members, child)
+		}
+	}
+	sort.Strings(members)
+
+	return members, nil
+}
+
+func (b *DoubleBarrier) delete(node string) {
+	if err := b.client.DeleteOwned(node); err != nil && err != zk.ErrNoNode && err != ErrNotOwner {
+		log.Printf("error in leave double barrier %s: %v\n", node, err)
+	}
+}
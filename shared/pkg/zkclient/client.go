@@ -1,32 +1,86 @@
 package zkclient
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-zookeeper/zk"
 )
 
+// ErrNotOwner is returned when an ephemeral node belongs to another session
+var ErrNotOwner = errors.New("zknode owned by another session")
+
+// ErrFenced is returned when the fencing znode changed before a write
+var ErrFenced = errors.New("fencing znode changed")
+
 type ZooKeeperClient struct {
-	conn *zk.Conn
+	conn   *zk.Conn
+	config Config
+
+	mu          sync.Mutex
+	expired     bool
+	ready       chan struct{}
+	ephemerals  map[string][]byte
+	subscribers []chan SessionEvent
+	closed      chan struct{}
+	watches     *watchSession
 }
 
-func NewZooKeeperClient(servers []string) (*ZooKeeperClient, error) {
-	conn, _, err := zk.Connect(servers, time.Second)
+func NewZooKeeperClient(config Config) (*ZooKeeperClient, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	dialer := func(network, address string, _ time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, address, config.ConnectTimeout)
+	}
+	conn, events, err := zk.Connect(config.Servers, config.SessionTimeout, zk.WithDialer(dialer))
 	if err != nil {
 		return nil, err
 	}
 
-	return &ZooKeeperClient{conn: conn}, nil
+	c := &ZooKeeperClient{
+		conn:       conn,
+		config:     config,
+		ready:      make(chan struct{}),
+		ephemerals: make(map[string][]byte),
+		closed:     make(chan struct{}),
+	}
+	go c.handleEvents(events)
+
+	// the credential is sent again by the zk library after every reconnect
+	if config.Auth != "" {
+		if err := conn.AddAuth("digest", []byte(config.Auth)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error in authenticate zookeeper: %v", err)
+		}
+	}
+
+	if err := c.createChroot(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
 }
 
 func (c *ZooKeeperClient) Close() {
+	c.mu.Lock()
+	watches := c.watches
+	c.mu.Unlock()
+	if watches != nil {
+		watches.close()
+	}
+
 	c.conn.Close()
 }
 
 func (c *ZooKeeperClient) Create(path string, data []byte) error {
-	_, err := c.conn.Create(path, data, 0, zk.WorldACL(zk.PermAll))
+	_, err := c.conn.Create(c.path(path), data, 0, c.config.aclFor(path))
 	if err != nil {
 		return err
 	}
@@ -34,8 +88,17 @@ func (c *ZooKeeperClient) Create(path string, data []byte) error {
 	return nil
 }
 
+func (c *ZooKeeperClient) CreateIfNotExists(path string, data []byte) error {
+	err := c.Create(path, data)
+	if err != nil && err != zk.ErrNodeExists {
+		return err
+	}
+
+	return nil
+}
+
 func (c *ZooKeeperClient) CreateSequential(path string, data []byte) (string, error) {
-	nodePath, err := c.conn.Create(path, data, zk.FlagSequence, zk.WorldACL(zk.PermAll))
+	nodePath, err := c.conn.Create(c.path(path), data, zk.FlagSequence, c.config.aclFor(path))
 	if err != nil {
 		return "", err
 	}
@@ -45,26 +108,41 @@ func (c *ZooKeeperClient) CreateSequential(path string, data []byte) (string, er
 	return nodes[len(nodes)-1], nil
 }
 
+// CreateEmphemeral nodes are created again when the session is rebuilt
+// after an expiry, until they are deleted. They fit memberships, a node
+// which grants something exclusive is created with CreateLockNode.
 func (c *ZooKeeperClient) CreateEmphemeral(path string, data []byte) error {
-	_, err := c.conn.Create(path, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	_, err := c.conn.Create(c.path(path), data, zk.FlagEphemeral, c.config.aclFor(path))
 	if err != nil {
 		return err
 	}
 
+	c.mu.Lock()
+	c.ephemerals[path] = data
+	c.mu.Unlock()
+
 	return nil
 }
 
+// CreateLockNode creates an ephemeral node which is not restored after an
+// expiry, another session may own the path by then. Its owner must acquire
+// it again once the session is restored.
+func (c *ZooKeeperClient) CreateLockNode(path string, data []byte) error {
+	_, err := c.conn.Create(c.path(path), data, zk.FlagEphemeral, c.config.aclFor(path))
+	return err
+}
+
 func (c *ZooKeeperClient) CreateProtectedEphemeralSequentialNode(path string, data []byte) (string, error) {
-	nodePath, err := c.conn.CreateProtectedEphemeralSequential(path, data, zk.WorldACL(zk.PermAll))
+	nodePath, err := c.conn.CreateProtectedEphemeralSequential(c.path(path), data, c.config.aclFor(path))
 	if err != nil {
 		return "", err
 	}
 
-	return nodePath, nil
+	return c.relative(nodePath), nil
 }
 
 func (c *ZooKeeperClient) Set(path string, data []byte) error {
-	_, err := c.conn.Set(path, data, -1)
+	_, err := c.conn.Set(c.path(path), data, -1)
 	if err != nil {
 		return err
 	}
@@ -73,7 +151,7 @@ func (c *ZooKeeperClient) Set(path string, data []byte) error {
 }
 
 func (c *ZooKeeperClient) Get(path string) ([]byte, error) {
-	data, _, err := c.conn.Get(path)
+	data, _, err := c.conn.Get(c.path(path))
 	if err != nil {
 		return nil, err
 	}
@@ -81,17 +159,64 @@ func (c *ZooKeeperClient) Get(path string) ([]byte, error) {
 	return data, nil
 }
 
+func (c *ZooKeeperClient) GetWithVersion(path string) ([]byte, int32, error) {
+	data, stat, err := c.conn.Get(c.path(path))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return data, stat.Version, nil
+}
+
+// SetWithVersion only writes the znode if its version still matches,
+// it returns zk.ErrBadVersion when another writer got there first.
+func (c *ZooKeeperClient) SetWithVersion(path string, data []byte, version int32) error {
+	_, err := c.conn.Set(c.path(path), data, version)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetWithVersionFenced writes the znode like SetWithVersion, in one multi
+// with a check that the fence znode still has its version, e.g. the epoch
+// of the leader which writes. It returns ErrFenced when the fence moved.
+func (c *ZooKeeperClient) SetWithVersionFenced(path string, data []byte, version int32, fence string, fenceVersion int32) error {
+	responses, err := c.conn.Multi(
+		&zk.CheckVersionRequest{Path: c.path(fence), Version: fenceVersion},
+		&zk.SetDataRequest{Path: c.path(path), Data: data, Version: version},
+	)
+	if err == nil {
+		return nil
+	}
+
+	if len(responses) == 2 {
+		if responses[0].Error == zk.ErrBadVersion {
+			return ErrFenced
+		}
+		if responses[0].Error != nil {
+			return responses[0].Error
+		}
+		if responses[1].Error != nil {
+			return responses[1].Error
+		}
+	}
+
+	return err
+}
+
 func (c *ZooKeeperClient) GetW(path string) ([]byte, <-chan zk.Event, error) {
-	data, _, ch, err := c.conn.GetW(path)
+	data, _, ch, err := c.conn.GetW(c.path(path))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return data, ch, nil
+	return data, c.wrapWatch(ch), nil
 }
 
 func (c *ZooKeeperClient) Exists(path string) (bool, error) {
-	exists, _, err := c.conn.Exists(path)
+	exists, _, err := c.conn.Exists(c.path(path))
 	if err != nil {
 		return false, err
 	}
@@ -100,16 +225,16 @@ func (c *ZooKeeperClient) Exists(path string) (bool, error) {
 }
 
 func (c *ZooKeeperClient) ExistsW(path string) (bool, <-chan zk.Event, error) {
-	exists, _, ch, err := c.conn.ExistsW(path)
+	exists, _, ch, err := c.conn.ExistsW(c.path(path))
 	if err != nil {
 		return false, nil, err
 	}
 
-	return exists, ch, nil
+	return exists, c.wrapWatch(ch), nil
 }
 
 func (c *ZooKeeperClient) Children(path string) ([]string, error) {
-	children, _, err := c.conn.Children(path)
+	children, _, err := c.conn.Children(c.path(path))
 	if err != nil {
 		return nil, err
 	}
@@ -118,21 +243,60 @@ func (c *ZooKeeperClient) Children(path string) ([]string, error) {
 }
 
 func (c *ZooKeeperClient) ChildrenW(path string) ([]string, <-chan zk.Event, error) {
-	children, _, ch, err := c.conn.ChildrenW(path)
+	children, _, ch, err := c.conn.ChildrenW(c.path(path))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return children, ch, nil
+	return children, c.wrapWatch(ch), nil
 }
 
 func (c *ZooKeeperClient) Delete(path string) error {
-	err := c.conn.Delete(path, -1)
+	err := c.conn.Delete(c.path(path), -1)
+	if err == nil || err == zk.ErrNoNode {
+		c.mu.Lock()
+		delete(c.ephemerals, path)
+		c.mu.Unlock()
+	}
+
+	return err
+}
+
+// DeleteOwned deletes an ephemeral node of the current session only, a node
+// created again by another session after an expiry is left alone.
+func (c *ZooKeeperClient) DeleteOwned(path string) error {
+	owned, version, err := c.owned(path)
 	if err != nil {
 		return err
 	}
+	if !owned {
+		c.mu.Lock()
+		delete(c.ephemerals, path)
+		c.mu.Unlock()
+		return ErrNotOwner
+	}
 
-	return nil
+	err = c.conn.Delete(c.path(path), version)
+	if err == nil || err == zk.ErrNoNode {
+		c.mu.Lock()
+		delete(c.ephemerals, path)
+		c.mu.Unlock()
+	}
+
+	return err
+}
+
+// owned reports whether the node is an ephemeral of the current session
+func (c *ZooKeeperClient) owned(path string) (bool, int32, error) {
+	exists, stat, err := c.conn.Exists(c.path(path))
+	if err != nil {
+		return false, 0, err
+	}
+	if !exists {
+		return false, 0, zk.ErrNoNode
+	}
+
+	return stat.EphemeralOwner == c.conn.SessionID(), stat.Version, nil
 }
 
 func (c *ZooKeeperClient) DeleteRecursive(path string) error {
@@ -149,10 +313,47 @@ func (c *ZooKeeperClient) DeleteRecursive(path string) error {
 		}
 	}
 
-	err = c.conn.Delete(path, -1)
+	err = c.conn.Delete(c.path(path), -1)
 	if err != nil {
 		return fmt.Errorf("failed to delete %s: %v", path, err)
 	}
 
 	return nil
 }
+
+// path maps a client path into the chroot namespace
+func (c *ZooKeeperClient) path(path string) string {
+	if c.config.Chroot == "" {
+		return path
+	}
+	if path == "/" {
+		return c.config.Chroot
+	}
+
+	return c.config.Chroot + path
+}
+
+func (c *ZooKeeperClient) relative(path string) string {
+	if relative, ok := c.relativePath(path); ok {
+		return relative
+	}
+
+	return path
+}
+
+func (c *ZooKeeperClient) createChroot() error {
+	if c.config.Chroot == "" {
+		return nil
+	}
+
+	path := ""
+	for _, node := range strings.Split(strings.TrimPrefix(c.config.Chroot, "/"), "/") {
+		path += "/" + node
+		_, err := c.conn.Create(path, []byte{}, 0, c.config.aclFor("/"))
+		if err != nil && err != zk.ErrNodeExists {
+			return fmt.Errorf("error in create chroot %s: %v", path, err)
+		}
+	}
+
+	return nil
+}
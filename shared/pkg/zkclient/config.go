@@ -0,0 +1,188 @@
+package zkclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// Config describes how to reach the ZooKeeper ensemble. Every path used by
+// the client is relative to Chroot.
+type Config struct {
+	Servers        []string      `json:"servers"`
+	Chroot         string        `json:"chroot"`
+	SessionTimeout time.Duration `json:"-"`
+	ConnectTimeout time.Duration `json:"-"`
+	// Auth is the digest credential in the user:password form
+	Auth string    `json:"auth"`
+	ACL  []ACLRule `json:"acl"`
+}
+
+// ACLRule applies an ACL to every znode created under Path. The longest
+// matching path wins, and Perms uses the zkCli letters, e.g. "crdwa".
+type ACLRule struct {
+	Path   string `json:"path"`
+	Scheme string `json:"scheme"`
+	Id     string `json:"id"`
+	Perms  string `json:"perms"`
+}
+
+var DefaultConfig = Config{
+	Servers:        []string{"127.0.0.1:2181"},
+	SessionTimeout: time.Second,
+	ConnectTimeout: time.Second,
+}
+
+// LoadConfig reads the JSON file from ZK_CONFIG when it is set, then
+// applies the ZK_SERVERS, ZK_CHROOT, ZK_SESSION_TIMEOUT, ZK_CONNECT_TIMEOUT
+// and ZK_AUTH environment variables. ZK_SERVER is still accepted for a
+// single server.
+func LoadConfig() (Config, error) {
+	config := DefaultConfig
+
+	if path, ok := syscall.Getenv("ZK_CONFIG"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("error in read zookeeper config %s: %v", path, err)
+		}
+
+		// the timeouts are written as durations in the file, e.g. "5s"
+		file := struct {
+			*Config
+			SessionTimeout string `json:"session_timeout"`
+			ConnectTimeout string `json:"connect_timeout"`
+		}{Config: &config}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return Config{}, fmt.Errorf("error in unmarshal zookeeper config %s: %v", path, err)
+		}
+
+		if err := parseTimeout(file.SessionTimeout, &config.SessionTimeout); err != nil {
+			return Config{}, err
+		}
+		if err := parseTimeout(file.ConnectTimeout, &config.ConnectTimeout); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if servers, ok := syscall.Getenv("ZK_SERVERS"); ok {
+		config.Servers = strings.Split(servers, ",")
+	} else if server, ok := syscall.Getenv("ZK_SERVER"); ok {
+		config.Servers = []string{server}
+	}
+
+	if chroot, ok := syscall.Getenv("ZK_CHROOT"); ok {
+		config.Chroot = chroot
+	}
+
+	if value, ok := syscall.Getenv("ZK_SESSION_TIMEOUT"); ok {
+		if err := parseTimeout(value, &config.SessionTimeout); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if value, ok := syscall.Getenv("ZK_CONNECT_TIMEOUT"); ok {
+		if err := parseTimeout(value, &config.ConnectTimeout); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if auth, ok := syscall.Getenv("ZK_AUTH"); ok {
+		config.Auth = auth
+	}
+
+	return config, config.validate()
+}
+
+func (c *Config) validate() error {
+	if len(c.Servers) == 0 {
+		return fmt.Errorf("zookeeper servers not configured")
+	}
+
+	c.Chroot = strings.TrimSuffix(c.Chroot, "/")
+	if c.Chroot != "" && !strings.HasPrefix(c.Chroot, "/") {
+		return fmt.Errorf("zookeeper chroot %s must be an absolute path", c.Chroot)
+	}
+
+	if c.Auth != "" && !strings.Contains(c.Auth, ":") {
+		return fmt.Errorf("zookeeper auth must be user:password")
+	}
+
+	for _, rule := range c.ACL {
+		if _, err := parsePerms(rule.Perms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// aclFor returns the ACL of the longest matching rule. Without a rule the
+// znode is open to the world, or to the authenticated user when digest
+// authentication is configured.
+func (c *Config) aclFor(path string) []zk.ACL {
+	var match *ACLRule
+	for i, rule := range c.ACL {
+		if path != rule.Path && !strings.HasPrefix(path, strings.TrimSuffix(rule.Path, "/")+"/") {
+			continue
+		}
+		if match == nil || len(rule.Path) > len(match.Path) {
+			match = &c.ACL[i]
+		}
+	}
+
+	if match != nil {
+		perms, _ := parsePerms(match.Perms)
+		return []zk.ACL{{Perms: perms, Scheme: match.Scheme, ID: match.Id}}
+	}
+
+	if c.Auth != "" {
+		return zk.AuthACL(zk.PermAll)
+	}
+
+	return zk.WorldACL(zk.PermAll)
+}
+
+func parseTimeout(value string, timeout *time.Duration) error {
+	if value == "" {
+		return nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("error in parse zookeeper timeout %s: %v", value, err)
+	}
+	*timeout = duration
+
+	return nil
+}
+
+func parsePerms(value string) (int32, error) {
+	if value == "" {
+		return zk.PermAll, nil
+	}
+
+	var perms int32
+	for _, p := range value {
+		switch p {
+		case 'c':
+			perms |= zk.PermCreate
+		case 'r':
+			perms |= zk.PermRead
+		case 'd':
+			perms |= zk.PermDelete
+		case 'w':
+			perms |= zk.PermWrite
+		case 'a':
+			perms |= zk.PermAdmin
+		default:
+			return 0, fmt.Errorf("invalid zookeeper permission %q in %s", p, value)
+		}
+	}
+
+	return perms, nil
+}
@@ -0,0 +1,154 @@
+package zkclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// Election implements the ZooKeeper leader election recipe, every candidate
+// owns an ephemeral sequential znode and the lowest sequence is the leader.
+type Election struct {
+	client *ZooKeeperClient
+	path   string
+	id     string
+	node   string
+}
+
+func NewElection(client *ZooKeeperClient, path string, id string) *Election {
+	return &Election{
+		client: client,
+		path:   path,
+		id:     id,
+	}
+}
+
+// Campaign blocks until this candidate becomes the leader. It returns false
+// when stop is closed before the leadership is acquired.
+func (e *Election) Campaign(stop <-chan struct{}) (bool, error) {
+	if e.node == "" {
+		nodePath, err := e.client.CreateProtectedEphemeralSequentialNode(e.path+"/n_", []byte(e.id))
+		if err != nil {
+			return false, fmt.Errorf("error in create election znode: %v", err)
+		}
+		e.node = nodePath[strings.LastIndex(nodePath, "/")+1:]
+	}
+
+	for {
+		children, err := e.client.Children(e.path)
+		if err != nil {
+			return false, fmt.Errorf("error in list election candidates: %v", err)
+		}
+		sortBySequence(children)
+
+		index := -1
+		for i, child := range children {
+			if child == e.node {
+				index = i
+				break
+			}
+		}
+
+		// our ephemeral node is gone, the session has expired
+		if index < 0 {
+			node := e.node
+			e.node = ""
+			return false, fmt.Errorf("election znode %s not found", node)
+		}
+
+		if index == 0 {
+			return true, nil
+		}
+
+		// only watch the predecessor to avoid the herd effect
+		exists, ch, err := e.client.ExistsW(e.path + "/" + children[index-1])
+		if err != nil {
+			return false, fmt.Errorf("error in watch election predecessor: %v", err)
+		}
+		if !exists {
+			continue
+		}
+
+		select {
+		case <-stop:
+			return false, nil
+		case <-ch:
+		}
+	}
+}
+
+// Watch returns a channel which fires when the candidate znode changes,
+// a deleted candidate znode means the leadership is lost.
+func (e *Election) Watch() (<-chan zk.Event, error) {
+	if e.node == "" {
+		return nil, fmt.Errorf("election candidate not registered")
+	}
+
+	exists, ch, err := e.client.ExistsW(e.path + "/" + e.node)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		e.node = ""
+		return nil, fmt.Errorf("election candidate znode not found")
+	}
+
+	return ch, nil
+}
+
+func (e *Election) Resign() error {
+	if e.node == "" {
+		return nil
+	}
+
+	err := e.client.DeleteOwned(e.path + "/" + e.node)
+	if err != nil && err != zk.ErrNoNode && err != ErrNotOwner {
+		return err
+	}
+	e.node = ""
+
+	return nil
+}
+
+// Members returns the ids of all live candidates.
+func (e *Election) Members() ([]string, error) {
+	children, err := e.client.Children(e.path)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(children))
+	for _, child := range children {
+		data, err := e.client.Get(e.path + "/" + child)
+		if err != nil {
+			if err == zk.ErrNoNode {
+				continue
+			}
+			return nil, err
+		}
+		members = append(members, string(data))
+	}
+
+	return members, nil
+}
+
+func (e *Election) Id() string {
+	return e.id
+}
+
+// sequential znodes end with a 10 digits counter, protected znodes carry a
+// random prefix so only the suffix can be compared
+func sortBySequence(nodes []string) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return sequence(nodes[i]) < sequence(nodes[j])
+	})
+}
+
+func sequence(node string) string {
+	if len(node) < 10 {
+		return node
+	}
+	return node[len(node)-10:]
+}
@@ -0,0 +1,218 @@
+package zkclient
+
+import (
+	"log"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+type SessionState string
+
+const (
+	SessionConnected    SessionState = "CONNECTED"
+	SessionDisconnected SessionState = "DISCONNECTED"
+	SessionExpired      SessionState = "EXPIRED"
+	// SessionRestored means a new session replaced an expired one, the
+	// membership ephemerals are created again, locks are not, and every
+	// watch must be re-armed.
+	SessionRestored SessionState = "RESTORED"
+	// SessionEphemeralLost means the ephemeral znode at Path could not be
+	// restored, another session owns it now. Its owner must not use it.
+	SessionEphemeralLost SessionState = "EPHEMERAL_LOST"
+)
+
+type SessionEvent struct {
+	State     SessionState
+	SessionId int64
+	Path      string
+}
+
+// Subscribe returns a channel receiving the connection state changes.
+// Slow subscribers miss events instead of blocking the client.
+func (c *ZooKeeperClient) Subscribe() <-chan SessionEvent {
+	ch := make(chan SessionEvent, 16)
+
+	c.mu.Lock()
+	c.subscribers = append(c.subscribers, ch)
+	c.mu.Unlock()
+
+	return ch
+}
+
+func (c *ZooKeeperClient) Unsubscribe(ch <-chan SessionEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, subscriber := range c.subscribers {
+		if subscriber == ch {
+			c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
+			close(subscriber)
+			return
+		}
+	}
+}
+
+func (c *ZooKeeperClient) publish(state SessionState) {
+	c.publishEvent(SessionEvent{State: state, SessionId: c.conn.SessionID()})
+}
+
+func (c *ZooKeeperClient) publishEvent(event SessionEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, subscriber := range c.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// handleEvents follows the session of the connection. The zk library opens
+// a new session by itself after an expiry, so we only have to restore the
+// ephemeral znodes and wake up the watches lost with the old session.
+func (c *ZooKeeperClient) handleEvents(events <-chan zk.Event) {
+	for event := range events {
+		if event.Type != zk.EventSession {
+			continue
+		}
+
+		switch event.State {
+		case zk.StateHasSession:
+			c.mu.Lock()
+			expired := c.expired
+			c.expired = false
+			c.mu.Unlock()
+
+			if !expired {
+				c.setReady()
+				c.publish(SessionConnected)
+				continue
+			}
+
+			log.Printf("zookeeper session restored: %d\n", c.conn.SessionID())
+			// the event channel must keep draining while the ephemerals are created
+			go func() {
+				c.restoreEphemerals()
+				c.setReady()
+				c.publish(SessionRestored)
+			}()
+		case zk.StateDisconnected:
+			c.resetReady()
+			c.publish(SessionDisconnected)
+		case zk.StateExpired:
+			log.Println("zookeeper session expired")
+			c.mu.Lock()
+			c.expired = true
+			c.mu.Unlock()
+			c.resetReady()
+			c.publish(SessionExpired)
+		}
+	}
+
+	// the connection is closed
+	close(c.closed)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, subscriber := range c.subscribers {
+		close(subscriber)
+	}
+	c.subscribers = nil
+}
+
+func (c *ZooKeeperClient) restoreEphemerals() {
+	c.mu.Lock()
+	ephemerals := make(map[string][]byte, len(c.ephemerals))
+	for path, data := range c.ephemerals {
+		ephemerals[path] = data
+	}
+	c.mu.Unlock()
+
+	for path, data := range ephemerals {
+		_, err := c.conn.Create(c.path(path), data, zk.FlagEphemeral, c.config.aclFor(path))
+		if err == zk.ErrNodeExists {
+			// created again by this session in the meantime, or by another one
+			var owned bool
+			if owned, _, err = c.owned(path); err == nil && !owned {
+				err = ErrNotOwner
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		log.Printf("error in restore ephemeral znode %s: %v\n", path, err)
+		c.mu.Lock()
+		delete(c.ephemerals, path)
+		c.mu.Unlock()
+		c.publishEvent(SessionEvent{State: SessionEphemeralLost, SessionId: c.conn.SessionID(), Path: path})
+	}
+}
+
+func (c *ZooKeeperClient) setReady() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.ready:
+	default:
+		close(c.ready)
+	}
+}
+
+func (c *ZooKeeperClient) resetReady() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.ready:
+		c.ready = make(chan struct{})
+	default:
+	}
+}
+
+// waitSession blocks until the client holds a live session. The state is
+// polled as well, the watch events and the session events are not ordered.
+func (c *ZooKeeperClient) waitSession() {
+	for {
+		c.mu.Lock()
+		ready := c.ready
+		expired := c.expired
+		c.mu.Unlock()
+
+		if !expired && c.conn.State() == zk.StateHasSession {
+			return
+		}
+
+		select {
+		case <-ready:
+		case <-c.closed:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// wrapWatch holds back the watch events caused by a session expiry until a
+// new session exists, so the caller re-registers its watch on a live
+// session instead of spinning on connection errors.
+func (c *ZooKeeperClient) wrapWatch(ch <-chan zk.Event) <-chan zk.Event {
+	out := make(chan zk.Event, 1)
+	go func() {
+		event, ok := <-ch
+		if !ok {
+			close(out)
+			return
+		}
+
+		if event.Err == zk.ErrSessionExpired {
+			c.waitSession()
+		}
+		event.Path = c.relative(event.Path)
+		out <- event
+	}()
+
+	return out
+}
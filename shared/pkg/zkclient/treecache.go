@@ -0,0 +1,351 @@
+package zkclient
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+type TreeEventType string
+
+const (
+	NodeAdded   TreeEventType = "NODE_ADDED"
+	NodeUpdated TreeEventType = "NODE_UPDATED"
+	NodeRemoved TreeEventType = "NODE_REMOVED"
+)
+
+type TreeEvent struct {
+	Type TreeEventType
+	Path string
+	Data []byte
+}
+
+type treeSubscriber struct {
+	ch     chan TreeEvent
+	queue  []TreeEvent
+	notify chan struct{}
+}
+
+type cachedNode struct {
+	data     []byte
+	children map[string]bool
+}
+
+// TreeCache mirrors a subtree in memory. Every node down to maxDepth keeps
+// a data and a children watch, so reads are answered without a round trip
+// to ZooKeeper, a negative maxDepth mirrors the whole subtree. The cache is
+// eventually consistent, a node created a moment ago may not be there yet.
+type TreeCache struct {
+	client      *ZooKeeperClient
+	root        string
+	maxDepth    int
+	nodes       map[string]*cachedNode
+	watched     map[string]bool
+	subscribers []*treeSubscriber
+	loaded      bool
+	mu          sync.RWMutex
+	stopChan    chan struct{}
+	wg          sync.WaitGroup
+}
+
+func NewTreeCache(client *ZooKeeperClient, root string, maxDepth int) *TreeCache {
+	return &TreeCache{
+		client:   client,
+		root:     root,
+		maxDepth: maxDepth,
+		nodes:    make(map[string]*cachedNode),
+		watched:  make(map[string]bool),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start loads the subtree and returns once the initial load is done
+func (t *TreeCache) Start() {
+	var initial sync.WaitGroup
+	initial.Add(1)
+	t.watched[t.root] = true
+	t.wg.Add(1)
+	go t.watchNode(t.root, 0, &initial)
+
+	initial.Wait()
+
+	t.mu.Lock()
+	t.loaded = true
+	t.mu.Unlock()
+}
+
+func (t *TreeCache) Stop() {
+	close(t.stopChan)
+	t.wg.Wait()
+}
+
+// Subscribe returns a channel receiving the changes of the subtree once the
+// initial load is done. The events are queued for slow subscribers, none of
+// them is dropped, and the channel is closed when the cache stops.
+func (t *TreeCache) Subscribe() <-chan TreeEvent {
+	subscriber := &treeSubscriber{
+		ch:     make(chan TreeEvent),
+		notify: make(chan struct{}, 1),
+	}
+
+	t.mu.Lock()
+	t.subscribers = append(t.subscribers, subscriber)
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+	go t.forward(subscriber)
+
+	return subscriber.ch
+}
+
+func (t *TreeCache) forward(subscriber *treeSubscriber) {
+	defer t.wg.Done()
+	defer close(subscriber.ch)
+
+	for {
+		select {
+		case <-t.stopChan:
+			return
+		case <-subscriber.notify:
+		}
+
+		t.mu.Lock()
+		queue := subscriber.queue
+		subscriber.queue = nil
+		t.mu.Unlock()
+
+		for _, event := range queue {
+			select {
+			case <-t.stopChan:
+				return
+			case subscriber.ch <- event:
+			}
+		}
+	}
+}
+
+func (t *TreeCache) Get(path string) ([]byte, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	node, ok := t.nodes[path]
+	if !ok {
+		return nil, false
+	}
+
+	return node.data, true
+}
+
+func (t *TreeCache) Children(path string) ([]string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	node, ok := t.nodes[path]
+	if !ok {
+		return nil, false
+	}
+
+	children := make([]string, 0, len(node.children))
+	for child := range node.children {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+
+	return children, true
+}
+
+func (t *TreeCache) Exists(path string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	_, ok := t.nodes[path]
+	return ok
+}
+
+func (t *TreeCache) watchNode(path string, depth int, initial *sync.WaitGroup) {
+	defer t.wg.Done()
+	defer func() {
+		t.mu.Lock()
+		delete(t.watched, path)
+		t.mu.Unlock()
+	}()
+
+	loaded := false
+	markLoaded := func() {
+		if !loaded {
+			loaded = true
+			if initial != nil {
+				initial.Done()
+			}
+		}
+	}
+	defer markLoaded()
+
+	// each watch is registered again only once it fired, a one-shot watch
+	// which is still pending would leave one more goroutine behind
+	var data []byte
+	var children []string
+	var dataCh, childrenCh <-chan zk.Event
+	watchChildren := t.maxDepth < 0 || depth < t.maxDepth
+	for {
+		select {
+		case <-t.stopChan:
+			return
+		default:
+		}
+
+		var err error
+		childrenRead := false
+		if dataCh == nil {
+			data, dataCh, err = t.client.GetW(path)
+			if err == zk.ErrNoNode {
+				t.remove(path)
+				return
+			}
+			if err != nil {
+				log.Printf("error in watch cached znode %s: %v\n", path, err)
+				dataCh = nil
+				t.sleep()
+				continue
+			}
+		}
+
+		if watchChildren && childrenCh == nil {
+			children, childrenCh, err = t.client.ChildrenW(path)
+			if err == zk.ErrNoNode {
+				t.remove(path)
+				return
+			}
+			if err != nil {
+				log.Printf("error in watch cached znode %s children: %v\n", path, err)
+				childrenCh = nil
+				t.sleep()
+				continue
+			}
+			childrenRead = true
+		}
+
+		for _, child := range t.update(path, data, children, childrenRead || !watchChildren) {
+			var childInitial *sync.WaitGroup
+			if !loaded && initial != nil {
+				initial.Add(1)
+				childInitial = initial
+			}
+			t.wg.Add(1)
+			go t.watchNode(path+"/"+child, depth+1, childInitial)
+		}
+		markLoaded()
+
+		select {
+		case <-t.stopChan:
+			return
+		case <-dataCh:
+			dataCh = nil
+		case <-childrenCh:
+			childrenCh = nil
+		}
+	}
+}
+
+// update stores the node and returns the children which are not watched yet,
+// the children are kept unless they were read again
+func (t *TreeCache) update(path string, data []byte, children []string, childrenRead bool) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node, exists := t.nodes[path]
+	if !exists {
+		node = &cachedNode{}
+		t.nodes[path] = node
+
+		if parent, ok := t.nodes[parentPath(path)]; ok && path != t.root {
+			parent.children[nodeName(path)] = true
+		}
+		t.publish(TreeEvent{Type: NodeAdded, Path: path, Data: data})
+	} else if !bytes.Equal(node.data, data) {
+		t.publish(TreeEvent{Type: NodeUpdated, Path: path, Data: data})
+	}
+	node.data = data
+
+	var added []string
+	if !childrenRead {
+		return added
+	}
+	node.children = make(map[string]bool, len(children))
+	for _, child := range children {
+		node.children[child] = true
+
+		childPath := path + "/" + child
+		if !t.watched[childPath] {
+			t.watched[childPath] = true
+			added = append(added, child)
+		}
+	}
+
+	return added
+}
+
+func (t *TreeCache) remove(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if parent, ok := t.nodes[parentPath(path)]; ok {
+		delete(parent.children, nodeName(path))
+	}
+
+	node, ok := t.nodes[path]
+	if !ok {
+		return
+	}
+
+	// the descendants are gone with their parent
+	for nodePath := range t.nodes {
+		if strings.HasPrefix(nodePath, path+"/") {
+			delete(t.nodes, nodePath)
+		}
+	}
+	delete(t.nodes, path)
+
+	t.publish(TreeEvent{Type: NodeRemoved, Path: path, Data: node.data})
+}
+
+// publish must be called with the lock held, the initial load is not
+// published since the subscribers read it from the cache.
+func (t *TreeCache) publish(event TreeEvent) {
+	if !t.loaded {
+		return
+	}
+
+	for _, subscriber := range t.subscribers {
+		subscriber.queue = append(subscriber.queue, event)
+		select {
+		case subscriber.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *TreeCache) sleep() {
+	select {
+	case <-t.stopChan:
+	case <-time.After(time.Second):
+	}
+}
+
+func parentPath(path string) string {
+	index := strings.LastIndex(path, "/")
+	if index <= 0 {
+		return "/"
+	}
+
+	return path[:index]
+}
+
+func nodeName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
@@ -0,0 +1,446 @@
+package zkclient
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+type AddWatchMode int
+
+const (
+	// AddWatchModePersistent watches the data and the children of the node
+	AddWatchModePersistent AddWatchMode = iota
+	// AddWatchModePersistentRecursive watches the node and all its descendants
+	AddWatchModePersistentRecursive
+)
+
+// Subscription delivers the changes of a persistent watch until it is closed
+type Subscription struct {
+	client  *ZooKeeperClient
+	session *watchSession
+	root    string
+	mode    AddWatchMode
+	nodes   map[string]*cachedNode
+	loaded  bool
+	mu      sync.RWMutex
+
+	notifications []zk.Event
+	stale         bool
+	notify        chan struct{}
+
+	events   chan TreeEvent
+	stopOnce sync.Once
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// AddWatch registers a ZooKeeper 3.6 persistent watch on path. Unlike
+// one-shot watches it stays registered after each event, so no change
+// happening between two events is missed. The watches of a client share
+// one session of their own, see watchSession.
+//
+// The subtree is read once when the watch is added, afterwards each
+// notification is applied in the order of the server and delivered through
+// Events, the initial state is read with Get and Children. ZooKeeper does
+// not send the data with the notification, a node is read when its event
+// is processed, so quick successive updates may arrive as a single event.
+// When the session is lost the subtree is read again on the new session
+// and the differences are delivered as events, the events channel is only
+// closed with the subscription.
+func (c *ZooKeeperClient) AddWatch(path string, mode AddWatchMode) (*Subscription, error) {
+	s := &Subscription{
+		client:   c,
+		session:  c.watchSession(),
+		root:     path,
+		mode:     mode,
+		nodes:    make(map[string]*cachedNode),
+		notify:   make(chan struct{}, 1),
+		events:   make(chan TreeEvent),
+		stopChan: make(chan struct{}),
+	}
+
+	// the watch is registered first, the changes happening during the load
+	// are queued and applied again afterwards
+	if err := s.session.add(s); err != nil {
+		return nil, err
+	}
+
+	if err := s.load(path); err != nil {
+		s.session.remove(s)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.loaded = true
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.process()
+
+	return s, nil
+}
+
+func (s *Subscription) Events() <-chan TreeEvent {
+	return s.events
+}
+
+// Get reads the node from the local state of the watch
+func (s *Subscription) Get(path string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node, ok := s.nodes[path]
+	if !ok {
+		return nil, false
+	}
+
+	return node.data, true
+}
+
+func (s *Subscription) Children(path string) ([]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node, ok := s.nodes[path]
+	if !ok {
+		return nil, false
+	}
+
+	children := make([]string, 0, len(node.children))
+	for child := range node.children {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+
+	return children, true
+}
+
+// Close removes the watch, the events channel is closed afterwards
+func (s *Subscription) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+	s.session.remove(s)
+	s.wg.Wait()
+}
+
+// covers reports whether a notification of path belongs to the watch
+func (s *Subscription) covers(path string) bool {
+	if path == s.root {
+		return true
+	}
+	if s.mode != AddWatchModePersistentRecursive {
+		return false
+	}
+
+	return s.root == "/" || strings.HasPrefix(path, s.root+"/")
+}
+
+// enqueue is called by the reader of the session, it never blocks
+func (s *Subscription) enqueue(eventType zk.EventType, path string) {
+	s.mu.Lock()
+	s.notifications = append(s.notifications, zk.Event{Type: eventType, Path: path})
+	s.mu.Unlock()
+
+	s.wake()
+}
+
+// markStale is called once the watch was added on a new session, the
+// notifications of the old one are replaced by a reload
+func (s *Subscription) markStale() {
+	s.mu.Lock()
+	s.stale = true
+	s.notifications = nil
+	s.mu.Unlock()
+
+	s.wake()
+}
+
+func (s *Subscription) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) process() {
+	defer s.wg.Done()
+	defer close(s.events)
+
+	for {
+		s.mu.Lock()
+		stale := s.stale
+		s.stale = false
+		notifications := s.notifications
+		if stale {
+			notifications = nil
+		}
+		s.notifications = nil
+		s.mu.Unlock()
+
+		events, err := s.sync(stale, notifications)
+		for _, event := range events {
+			select {
+			case <-s.stopChan:
+				return
+			case s.events <- event:
+			}
+		}
+
+		if err != nil {
+			// reloaded once the session is back, or on the next try
+			log.Printf("error in apply watch events on %s: %v\n", s.root, err)
+			s.mu.Lock()
+			s.stale = true
+			s.mu.Unlock()
+
+			select {
+			case <-s.stopChan:
+				return
+			case <-s.notify:
+			case <-time.After(watchReconnectDelay):
+			}
+			continue
+		}
+
+		select {
+		case <-s.stopChan:
+			return
+		case <-s.notify:
+		}
+	}
+}
+
+// sync reloads a stale subtree, or applies the notifications in order
+func (s *Subscription) sync(stale bool, notifications []zk.Event) ([]TreeEvent, error) {
+	if stale {
+		return s.reload()
+	}
+
+	var events []TreeEvent
+	for _, notification := range notifications {
+		applied, err := s.apply(notification)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, applied...)
+	}
+
+	return events, nil
+}
+
+// reload reads the subtree again and returns the differences with the
+// local state, the parents are added before their children. A root which
+// is gone removes the whole subtree.
+func (s *Subscription) reload() ([]TreeEvent, error) {
+	fresh := &Subscription{client: s.client, session: s.session, root: s.root, mode: s.mode, nodes: make(map[string]*cachedNode)}
+	if err := fresh.load(s.root); err != nil && err != zk.ErrNoNode {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(fresh.nodes))
+	for path := range fresh.nodes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var events []TreeEvent
+	for _, path := range paths {
+		events = append(events, s.update(path, fresh.nodes[path].data)...)
+	}
+
+	s.mu.RLock()
+	var gone []string
+	for path := range s.nodes {
+		if _, ok := fresh.nodes[path]; !ok {
+			gone = append(gone, path)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(gone)
+
+	for _, path := range gone {
+		events = append(events, s.remove(path)...)
+	}
+
+	return events, nil
+}
+
+// apply updates the local state with a notification and returns the
+// changes to deliver
+func (s *Subscription) apply(notification zk.Event) ([]TreeEvent, error) {
+	path := notification.Path
+
+	switch notification.Type {
+	case zk.EventNodeCreated, zk.EventNodeDataChanged:
+		if s.mode == AddWatchModePersistent && path != s.root {
+			return nil, nil
+		}
+
+		data, err := s.session.get(path)
+		if err == zk.ErrNoNode {
+			// deleted in the meantime, its own event follows
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return s.update(path, data), nil
+	case zk.EventNodeDeleted:
+		return s.remove(path), nil
+	case zk.EventNodeChildrenChanged:
+		return s.syncChildren(path)
+	}
+
+	return nil, nil
+}
+
+// load reads the node, and its descendants for a recursive watch
+func (s *Subscription) load(path string) error {
+	data, err := s.session.get(path)
+	if err == zk.ErrNoNode && path != s.root {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.update(path, data)
+
+	if path != s.root && s.mode == AddWatchModePersistent {
+		return nil
+	}
+
+	children, err := s.session.children(path)
+	if err == zk.ErrNoNode && path != s.root {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := s.load(childPath(path, child)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncChildren compares the children of the root with the local state, a
+// persistent watch is only notified of the root
+func (s *Subscription) syncChildren(path string) ([]TreeEvent, error) {
+	if path != s.root {
+		return nil, nil
+	}
+
+	children, err := s.session.children(path)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	known := make(map[string]bool)
+	if node, ok := s.nodes[path]; ok {
+		for child := range node.children {
+			known[child] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	var events []TreeEvent
+	for _, child := range children {
+		if known[child] {
+			delete(known, child)
+			continue
+		}
+
+		data, err := s.session.get(childPath(path, child))
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, s.update(childPath(path, child), data)...)
+	}
+	for child := range known {
+		events = append(events, s.remove(childPath(path, child))...)
+	}
+
+	return events, nil
+}
+
+func (s *Subscription) update(path string, data []byte) []TreeEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[path]
+	if exists {
+		if bytes.Equal(node.data, data) {
+			return nil
+		}
+
+		node.data = data
+		return s.publish(TreeEvent{Type: NodeUpdated, Path: path, Data: data})
+	}
+
+	s.nodes[path] = &cachedNode{data: data, children: make(map[string]bool)}
+	if parent, ok := s.nodes[parentPath(path)]; ok && path != s.root {
+		parent.children[nodeName(path)] = true
+	}
+
+	return s.publish(TreeEvent{Type: NodeAdded, Path: path, Data: data})
+}
+
+func (s *Subscription) remove(path string) []TreeEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if parent, ok := s.nodes[parentPath(path)]; ok {
+		delete(parent.children, nodeName(path))
+	}
+
+	node, ok := s.nodes[path]
+	if !ok {
+		return nil
+	}
+
+	// the descendants are gone with their parent
+	for nodePath := range s.nodes {
+		if strings.HasPrefix(nodePath, path+"/") {
+			delete(s.nodes, nodePath)
+		}
+	}
+	delete(s.nodes, path)
+
+	return s.publish(TreeEvent{Type: NodeRemoved, Path: path, Data: node.data})
+}
+
+// publish must be called with the lock held, the initial load is not
+// published since the subscriber reads it with Get
+func (s *Subscription) publish(event TreeEvent) []TreeEvent {
+	if !s.loaded {
+		return nil
+	}
+
+	return []TreeEvent{event}
+}
+
+func childPath(path, child string) string {
+	if path == "/" {
+		return "/" + child
+	}
+
+	return path + "/" + child
+}
@@ -0,0 +1,512 @@
+package zkclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// go-zookeeper does not implement the AddWatch request of ZooKeeper 3.6, so
+// the persistent watches use a session of their own speaking the few
+// requests they need. The watches and the reads of the subscriptions share
+// this session, so a read issued after a notification sees the change it
+// reports.
+
+const (
+	opGetData       = 4
+	opGetChildren   = 8
+	opPing          = 11
+	opRemoveWatches = 18
+	opSetAuth       = 100
+	opAddWatch      = 106
+	opClose         = -11
+
+	xidNotification = -1
+	xidPing         = -2
+	xidAuth         = -4
+
+	// watcher types of the RemoveWatches request
+	watcherTypePersistent          = 4
+	watcherTypePersistentRecursive = 5
+)
+
+var (
+	errWatchConnClosed = errors.New("watch connection closed")
+	errNoWatcher       = errors.New("zk: watcher does not exist")
+	errUnimplemented   = errors.New("zk: request not implemented, zookeeper 3.6 or later is required")
+)
+
+// zkErrors maps the error codes of the replies, go-zookeeper keeps its own
+// mapping unexported
+var zkErrors = map[int32]error{
+	-4:   zk.ErrConnectionClosed,
+	-6:   errUnimplemented,
+	-8:   zk.ErrBadArguments,
+	-100: zk.ErrAPIError,
+	-101: zk.ErrNoNode,
+	-102: zk.ErrNoAuth,
+	-103: zk.ErrBadVersion,
+	-108: zk.ErrNoChildrenForEphemerals,
+	-110: zk.ErrNodeExists,
+	-111: zk.ErrNotEmpty,
+	-112: zk.ErrSessionExpired,
+	-114: zk.ErrInvalidACL,
+	-115: zk.ErrAuthFailed,
+	-116: zk.ErrClosing,
+	-117: zk.ErrNothing,
+	-118: zk.ErrSessionMoved,
+	-121: errNoWatcher,
+	-123: zk.ErrReconfigDisabled,
+}
+
+func zkError(code int32) error {
+	if code == 0 {
+		return nil
+	}
+	if err, ok := zkErrors[code]; ok {
+		return err
+	}
+
+	return fmt.Errorf("zookeeper error %d", code)
+}
+
+type watchReply struct {
+	err  int32
+	body *packetReader
+}
+
+// watchConn is a ZooKeeper session which delivers the watch notifications
+// to notify, in the order of the server.
+type watchConn struct {
+	conn    net.Conn
+	timeout time.Duration
+	notify  func(eventType zk.EventType, path string)
+
+	mu      sync.Mutex
+	xid     int32
+	pending map[int32]chan watchReply
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func dialWatchConn(config Config, notify func(eventType zk.EventType, path string)) (*watchConn, error) {
+	var lastErr error
+	for _, server := range config.Servers {
+		conn, err := net.DialTimeout("tcp", server, config.ConnectTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		c := &watchConn{
+			conn:    conn,
+			timeout: config.SessionTimeout,
+			notify:  notify,
+			pending: make(map[int32]chan watchReply),
+			closed:  make(chan struct{}),
+		}
+		if err := c.connect(config.ConnectTimeout); err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+
+		go c.read()
+		go c.ping()
+
+		if config.Auth != "" {
+			if err := c.auth(config.Auth); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("error in connect watch session: %v", lastErr)
+}
+
+// connect opens a new session, the handshake packets have no header
+func (c *watchConn) connect(timeout time.Duration) error {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	w := &packetWriter{}
+	w.int32(0) // protocol version
+	w.int64(0) // last zxid seen
+	w.int32(int32(c.timeout / time.Millisecond))
+	w.int64(0) // session id
+	w.buffer(make([]byte, 16))
+	if err := c.writeFrame(w.buf); err != nil {
+		return err
+	}
+
+	frame, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+
+	r := &packetReader{buf: frame}
+	r.int32() // protocol version
+	negotiated := r.int32()
+	r.int64() // session id
+	if r.err != nil {
+		return r.err
+	}
+	if negotiated <= 0 {
+		return zk.ErrSessionExpired
+	}
+	c.timeout = time.Duration(negotiated) * time.Millisecond
+
+	return nil
+}
+
+func (c *watchConn) auth(credential string) error {
+	ch := make(chan watchReply, 1)
+	c.mu.Lock()
+	c.pending[xidAuth] = ch
+	c.mu.Unlock()
+
+	w := &packetWriter{}
+	w.int32(xidAuth)
+	w.int32(opSetAuth)
+	w.int32(0)
+	w.string("digest")
+	w.buffer([]byte(credential))
+	if err := c.write(w.buf); err != nil {
+		return err
+	}
+
+	reply, err := c.wait(xidAuth, ch)
+	if err != nil {
+		return err
+	}
+	if reply.err != 0 {
+		return zk.ErrAuthFailed
+	}
+
+	return nil
+}
+
+// watcherType maps the mode of an added watch to the type which removes it
+func watcherType(mode AddWatchMode) int32 {
+	if mode == AddWatchModePersistentRecursive {
+		return watcherTypePersistentRecursive
+	}
+
+	return watcherTypePersistent
+}
+
+func (c *watchConn) AddWatch(path string, mode AddWatchMode) error {
+	_, err := c.request(opAddWatch, func(w *packetWriter) {
+		w.string(path)
+		w.int32(int32(mode))
+	})
+
+	return err
+}
+
+// RemoveWatch removes a watch added with AddWatch, a watch which is already
+// gone is not an error
+func (c *watchConn) RemoveWatch(path string, mode AddWatchMode) error {
+	_, err := c.request(opRemoveWatches, func(w *packetWriter) {
+		w.string(path)
+		w.int32(watcherType(mode))
+	})
+	if err == errNoWatcher {
+		return nil
+	}
+
+	return err
+}
+
+func (c *watchConn) Get(path string) ([]byte, error) {
+	r, err := c.request(opGetData, func(w *packetWriter) {
+		w.string(path)
+		w.bool(false)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := r.buffer()
+	return data, r.err
+}
+
+func (c *watchConn) Children(path string) ([]string, error) {
+	r, err := c.request(opGetChildren, func(w *packetWriter) {
+		w.string(path)
+		w.bool(false)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	count := r.int32()
+	children := make([]string, 0, max(count, 0))
+	for i := int32(0); i < count && r.err == nil; i++ {
+		children = append(children, r.string())
+	}
+
+	return children, r.err
+}
+
+func (c *watchConn) request(op int32, body func(w *packetWriter)) (*packetReader, error) {
+	ch := make(chan watchReply, 1)
+
+	c.mu.Lock()
+	c.xid++
+	xid := c.xid
+	c.pending[xid] = ch
+	c.mu.Unlock()
+
+	w := &packetWriter{}
+	w.int32(xid)
+	w.int32(op)
+	body(w)
+	if err := c.write(w.buf); err != nil {
+		return nil, err
+	}
+
+	reply, err := c.wait(xid, ch)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := zkError(reply.err); err != nil {
+		return nil, err
+	}
+
+	return reply.body, nil
+}
+
+func (c *watchConn) wait(xid int32, ch chan watchReply) (watchReply, error) {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-c.closed:
+		return watchReply{}, errWatchConnClosed
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, xid)
+		c.mu.Unlock()
+		c.Close()
+		return watchReply{}, zk.ErrConnectionClosed
+	}
+}
+
+// read dispatches the replies and the notifications until the connection
+// is lost, the session is not resumed, a new one replaces it
+func (c *watchConn) read() {
+	defer c.Close()
+
+	for {
+		frame, err := c.readFrame()
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				log.Printf("error in read watch session: %v\n", err)
+			}
+			return
+		}
+
+		r := &packetReader{buf: frame}
+		xid := r.int32()
+		r.int64() // zxid
+		code := r.int32()
+		if r.err != nil {
+			log.Printf("error in read watch session reply: %v\n", r.err)
+			return
+		}
+
+		switch xid {
+		case xidNotification:
+			eventType := zk.EventType(r.int32())
+			r.int32() // keeper state
+			path := r.string()
+			if r.err != nil {
+				log.Printf("error in read watch notification: %v\n", r.err)
+				return
+			}
+			c.notify(eventType, path)
+		case xidPing:
+		default:
+			c.mu.Lock()
+			ch, ok := c.pending[xid]
+			delete(c.pending, xid)
+			c.mu.Unlock()
+
+			if ok {
+				ch <- watchReply{err: code, body: r}
+			}
+		}
+	}
+}
+
+func (c *watchConn) ping() {
+	ticker := time.NewTicker(c.timeout / 3)
+	defer ticker.Stop()
+
+	w := &packetWriter{}
+	w.int32(xidPing)
+	w.int32(opPing)
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if err := c.write(w.buf); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Close ends the session, the server removes its watches with it
+func (c *watchConn) Close() {
+	c.closeOnce.Do(func() {
+		w := &packetWriter{}
+		w.int32(0)
+		w.int32(opClose)
+		c.write(w.buf)
+
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// Closed is closed once the session is gone
+func (c *watchConn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+func (c *watchConn) write(packet []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.writeFrame(packet)
+}
+
+func (c *watchConn) writeFrame(packet []byte) error {
+	frame := make([]byte, 4+len(packet))
+	binary.BigEndian.PutUint32(frame, uint32(len(packet)))
+	copy(frame[4:], packet)
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *watchConn) readFrame() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// packetWriter and packetReader encode the jute records of the requests
+type packetWriter struct {
+	buf []byte
+}
+
+func (w *packetWriter) int32(v int32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v))
+}
+
+func (w *packetWriter) int64(v int64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v))
+}
+
+func (w *packetWriter) bool(v bool) {
+	if v {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *packetWriter) buffer(v []byte) {
+	w.int32(int32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *packetWriter) string(v string) {
+	w.buffer([]byte(v))
+}
+
+type packetReader struct {
+	buf []byte
+	err error
+}
+
+func (r *packetReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	data := r.buf[:n]
+	r.buf = r.buf[n:]
+	return data
+}
+
+func (r *packetReader) int32() int32 {
+	data := r.next(4)
+	if data == nil {
+		return 0
+	}
+
+	return int32(binary.BigEndian.Uint32(data))
+}
+
+func (r *packetReader) int64() int64 {
+	data := r.next(8)
+	if data == nil {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+// buffer reads a length prefixed value, -1 is a null value
+func (r *packetReader) buffer() []byte {
+	size := r.int32()
+	if size == -1 {
+		return nil
+	}
+
+	data := r.next(int(size))
+	if data == nil {
+		return nil
+	}
+
+	return append([]byte{}, data...)
+}
+
+func (r *packetReader) string() string {
+	return string(r.buffer())
+}
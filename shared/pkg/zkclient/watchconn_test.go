@@ -0,0 +1,674 @@
+package zkclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// fakeServer speaks the requests of the watch session, enough of the
+// ZooKeeper 3.6 wire protocol to test it without a real ensemble
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu       sync.Mutex
+	nodes    map[string][]byte
+	failures map[string]int32
+	sessions []*fakeSession
+	requests []string
+	nextId   int64
+	timeout  int32
+	down     bool
+}
+
+type fakeSession struct {
+	id      int64
+	conn    net.Conn
+	mu      sync.Mutex
+	watches map[string]int32
+}
+
+func newFakeServer(t *testing.T, nodes map[string]string) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{
+		t:        t,
+		listener: listener,
+		nodes:    map[string][]byte{"/": nil},
+		failures: make(map[string]int32),
+		timeout:  -1,
+	}
+	for path, data := range nodes {
+		s.nodes[path] = []byte(data)
+	}
+
+	go s.accept()
+	t.Cleanup(func() {
+		listener.Close()
+		s.dropSessions()
+	})
+
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		down := s.down
+		s.mu.Unlock()
+		if down {
+			conn.Close()
+			continue
+		}
+
+		go s.serve(conn)
+	}
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	frame, err := readTestFrame(conn)
+	if err != nil {
+		return
+	}
+	r := &packetReader{buf: frame}
+	r.int32() // protocol version
+	r.int64() // last zxid
+	timeout := r.int32()
+	r.int64() // session id
+	r.buffer()
+	if r.err != nil {
+		s.t.Errorf("bad connect request: %v", r.err)
+		return
+	}
+
+	s.mu.Lock()
+	s.nextId++
+	session := &fakeSession{id: s.nextId, conn: conn, watches: make(map[string]int32)}
+	s.sessions = append(s.sessions, session)
+	if s.timeout >= 0 {
+		timeout = s.timeout
+	}
+	s.mu.Unlock()
+
+	w := &packetWriter{}
+	w.int32(0)
+	w.int32(timeout)
+	w.int64(session.id)
+	w.buffer(make([]byte, 16))
+	session.write(w.buf)
+	if timeout <= 0 {
+		return
+	}
+
+	for {
+		frame, err := readTestFrame(conn)
+		if err != nil {
+			return
+		}
+
+		r := &packetReader{buf: frame}
+		xid := r.int32()
+		op := r.int32()
+		code, body := s.handle(session, op, r)
+		if op == opPing {
+			xid = xidPing
+		}
+
+		w := &packetWriter{}
+		w.int32(xid)
+		w.int64(0)
+		w.int32(code)
+		w.buf = append(w.buf, body...)
+		session.write(w.buf)
+
+		if op == opClose || (op == opSetAuth && code != 0) {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) handle(session *fakeSession, op int32, r *packetReader) (int32, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := &packetWriter{}
+	switch op {
+	case opPing, opClose:
+		return 0, nil
+	case opSetAuth:
+		r.int32()
+		r.string()
+		credential := string(r.buffer())
+		s.requests = append(s.requests, "setAuth "+credential)
+		if credential != "user:password" {
+			return -115, nil
+		}
+		return 0, nil
+	case opAddWatch:
+		path := r.string()
+		mode := r.int32()
+		s.requests = append(s.requests, fmt.Sprintf("addWatch %s %d", path, mode))
+		session.watches[path] = mode
+		return 0, nil
+	case opRemoveWatches:
+		path := r.string()
+		watcherType := r.int32()
+		s.requests = append(s.requests, fmt.Sprintf("removeWatches %s %d", path, watcherType))
+		if _, ok := session.watches[path]; !ok {
+			return -121, nil
+		}
+		delete(session.watches, path)
+		return 0, nil
+	case opGetData:
+		path := r.string()
+		if code, ok := s.failures[path]; ok {
+			return code, nil
+		}
+		data, ok := s.nodes[path]
+		if !ok {
+			return -101, nil
+		}
+		w.buffer(data)
+		w.buf = append(w.buf, make([]byte, 68)...) // stat
+		return 0, w.buf
+	case opGetChildren:
+		path := r.string()
+		if _, ok := s.nodes[path]; !ok {
+			return -101, nil
+		}
+		children := s.children(path)
+		w.int32(int32(len(children)))
+		for _, child := range children {
+			w.string(child)
+		}
+		return 0, w.buf
+	}
+
+	return -6, nil
+}
+
+// children must be called with the lock held
+func (s *fakeServer) children(path string) []string {
+	var children []string
+	for nodePath := range s.nodes {
+		if nodePath != "/" && parentPath(nodePath) == path {
+			children = append(children, nodeName(nodePath))
+		}
+	}
+	sort.Strings(children)
+
+	return children
+}
+
+func (s *fakeServer) set(path string, data string) {
+	s.mu.Lock()
+	_, exists := s.nodes[path]
+	s.nodes[path] = []byte(data)
+	s.mu.Unlock()
+
+	if exists {
+		s.trigger(path, zk.EventNodeDataChanged)
+	} else {
+		s.trigger(path, zk.EventNodeCreated)
+	}
+}
+
+func (s *fakeServer) delete(path string) {
+	s.mu.Lock()
+	delete(s.nodes, path)
+	s.mu.Unlock()
+
+	s.trigger(path, zk.EventNodeDeleted)
+}
+
+// trigger notifies every session once per event, like the server does
+// when several watches of a session cover the path
+func (s *fakeServer) trigger(path string, eventType zk.EventType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, session := range s.sessions {
+		notified := make(map[string]bool)
+		notify := func(eventType zk.EventType, path string) {
+			key := fmt.Sprintf("%d %s", eventType, path)
+			if notified[key] {
+				return
+			}
+			notified[key] = true
+			session.notify(eventType, path)
+		}
+
+		for watchPath, mode := range session.watches {
+			recursive := mode == int32(AddWatchModePersistentRecursive)
+			if path == watchPath || (recursive && (watchPath == "/" || strings.HasPrefix(path, watchPath+"/"))) {
+				notify(eventType, path)
+			}
+			if !recursive && eventType != zk.EventNodeDataChanged && parentPath(path) == watchPath {
+				notify(zk.EventNodeChildrenChanged, watchPath)
+			}
+		}
+	}
+}
+
+// dropSessions closes every connection, their sessions are gone
+func (s *fakeServer) dropSessions() {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = nil
+	s.mu.Unlock()
+
+	for _, session := range sessions {
+		session.conn.Close()
+	}
+}
+
+func (s *fakeServer) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) sessionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
+}
+
+func (s *fakeServer) requestLog() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.requests...)
+}
+
+func (session *fakeSession) notify(eventType zk.EventType, path string) {
+	w := &packetWriter{}
+	w.int32(xidNotification)
+	w.int64(-1)
+	w.int32(0)
+	w.int32(int32(eventType))
+	w.int32(int32(zk.StateSyncConnected))
+	w.string(path)
+	session.write(w.buf)
+}
+
+func (session *fakeSession) write(packet []byte) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(packet)))
+	session.conn.Write(append(frame, packet...))
+}
+
+func readTestFrame(conn net.Conn) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func newTestClient(t *testing.T, server *fakeServer, chroot string) *ZooKeeperClient {
+	c := &ZooKeeperClient{config: Config{
+		Servers:        []string{server.addr()},
+		Chroot:         chroot,
+		SessionTimeout: 2 * time.Second,
+		ConnectTimeout: time.Second,
+	}}
+	t.Cleanup(func() {
+		c.watchSession().close()
+	})
+
+	return c
+}
+
+func nextEvent(t *testing.T, sub *Subscription) TreeEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-sub.Events():
+		if !ok {
+			t.Fatal("events channel closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	return TreeEvent{}
+}
+
+func expectEvent(t *testing.T, sub *Subscription, eventType TreeEventType, path string, data string) {
+	t.Helper()
+
+	event := nextEvent(t, sub)
+	if event.Type != eventType || event.Path != path || string(event.Data) != data {
+		t.Fatalf("event = %s %s %q, want %s %s %q", event.Type, event.Path, event.Data, eventType, path, data)
+	}
+}
+
+func TestWatchConnConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout int32
+		auth    string
+		want    time.Duration
+		err     error
+	}{
+		{name: "requested timeout", timeout: -1, want: 2 * time.Second},
+		{name: "negotiated timeout", timeout: 4000, want: 4 * time.Second},
+		{name: "authenticated", timeout: -1, auth: "user:password", want: 2 * time.Second},
+		{name: "session refused", timeout: 0, err: zk.ErrSessionExpired},
+		{name: "authentication failed", timeout: -1, auth: "user:wrong", err: zk.ErrAuthFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, nil)
+			server.timeout = tt.timeout
+
+			config := Config{
+				Servers:        []string{"127.0.0.1:1", server.addr()},
+				SessionTimeout: 2 * time.Second,
+				ConnectTimeout: time.Second,
+				Auth:           tt.auth,
+			}
+			conn, err := dialWatchConn(config, func(zk.EventType, string) {})
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) && (err == nil || !strings.Contains(err.Error(), tt.err.Error())) {
+					t.Fatalf("dialWatchConn() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialWatchConn() error = %v", err)
+			}
+			defer conn.Close()
+
+			if conn.timeout != tt.want {
+				t.Errorf("timeout = %s, want %s", conn.timeout, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchConnErrors(t *testing.T) {
+	tests := []struct {
+		code int32
+		want error
+	}{
+		{code: 0, want: nil},
+		{code: -4, want: zk.ErrConnectionClosed},
+		{code: -6, want: errUnimplemented},
+		{code: -101, want: zk.ErrNoNode},
+		{code: -102, want: zk.ErrNoAuth},
+		{code: -103, want: zk.ErrBadVersion},
+		{code: -110, want: zk.ErrNodeExists},
+		{code: -111, want: zk.ErrNotEmpty},
+		{code: -112, want: zk.ErrSessionExpired},
+		{code: -115, want: zk.ErrAuthFailed},
+		{code: -118, want: zk.ErrSessionMoved},
+		{code: -121, want: errNoWatcher},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.code), func(t *testing.T) {
+			if err := zkError(tt.code); err != tt.want {
+				t.Errorf("zkError(%d) = %v, want %v", tt.code, err, tt.want)
+			}
+		})
+	}
+
+	if err := zkError(-999); err == nil || !strings.Contains(err.Error(), "-999") {
+		t.Errorf("zkError(-999) = %v, want an error with the code", err)
+	}
+
+	server := newFakeServer(t, map[string]string{"/secret": "x"})
+	server.failures["/secret"] = -102
+	conn, err := dialWatchConn(Config{Servers: []string{server.addr()}, SessionTimeout: 2 * time.Second, ConnectTimeout: time.Second}, func(zk.EventType, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Get("/secret"); err != zk.ErrNoAuth {
+		t.Errorf("Get(/secret) error = %v, want %v", err, zk.ErrNoAuth)
+	}
+	if _, err := conn.Get("/missing"); err != zk.ErrNoNode {
+		t.Errorf("Get(/missing) error = %v, want %v", err, zk.ErrNoNode)
+	}
+	if err := conn.RemoveWatch("/missing", AddWatchModePersistent); err != nil {
+		t.Errorf("RemoveWatch(/missing) error = %v, want nil", err)
+	}
+}
+
+func TestAddWatchNotifications(t *testing.T) {
+	server := newFakeServer(t, map[string]string{
+		"/transactions":       "",
+		"/transactions/1":     "INIT",
+		"/transactions/1/app": "INIT",
+	})
+	c := newTestClient(t, server, "")
+
+	sub, err := c.AddWatch("/transactions", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if data, ok := sub.Get("/transactions/1/app"); !ok || string(data) != "INIT" {
+		t.Errorf("Get(/transactions/1/app) = %q, %v, want INIT", data, ok)
+	}
+	if children, ok := sub.Children("/transactions"); !ok || strings.Join(children, ",") != "1" {
+		t.Errorf("Children(/transactions) = %v, %v, want [1]", children, ok)
+	}
+
+	server.set("/transactions/1", "PREPARED")
+	expectEvent(t, sub, NodeUpdated, "/transactions/1", "PREPARED")
+
+	server.set("/transactions/2", "INIT")
+	expectEvent(t, sub, NodeAdded, "/transactions/2", "INIT")
+
+	server.delete("/transactions/1/app")
+	expectEvent(t, sub, NodeRemoved, "/transactions/1/app", "INIT")
+
+	// outside of the watch
+	server.set("/other", "x")
+	server.set("/transactions/2", "READY")
+	expectEvent(t, sub, NodeUpdated, "/transactions/2", "READY")
+
+	if children, _ := sub.Children("/transactions"); strings.Join(children, ",") != "1,2" {
+		t.Errorf("Children(/transactions) = %v, want [1 2]", children)
+	}
+
+	requests := server.requestLog()
+	if len(requests) == 0 || requests[0] != "addWatch /transactions 1" {
+		t.Errorf("requests = %v, want the recursive watch first", requests)
+	}
+}
+
+func TestAddWatchSharedSession(t *testing.T) {
+	server := newFakeServer(t, map[string]string{
+		"/a": "",
+		"/b": "",
+	})
+	c := newTestClient(t, server, "")
+
+	first, err := c.AddWatch("/a", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.AddWatch("/b", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := c.AddWatch("/b", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if count := server.sessionCount(); count != 1 {
+		t.Fatalf("sessions = %d, want 1", count)
+	}
+
+	// each subscription only gets the events of its own watch
+	server.set("/a/1", "x")
+	server.set("/b/1", "y")
+	expectEvent(t, first, NodeAdded, "/a/1", "x")
+	expectEvent(t, second, NodeAdded, "/b/1", "y")
+	expectEvent(t, third, NodeAdded, "/b/1", "y")
+
+	// the watch of /b is still used by the second subscription
+	third.Close()
+	first.Close()
+	if _, ok := <-first.Events(); ok {
+		t.Error("events channel open after close")
+	}
+
+	server.set("/b/2", "z")
+	expectEvent(t, second, NodeAdded, "/b/2", "z")
+
+	want := []string{"addWatch /a 1", "addWatch /b 1", "removeWatches /a 5"}
+	var watches []string
+	for _, request := range server.requestLog() {
+		if strings.HasPrefix(request, "addWatch") || strings.HasPrefix(request, "removeWatches") {
+			watches = append(watches, request)
+		}
+	}
+	if strings.Join(watches, ",") != strings.Join(want, ",") {
+		t.Errorf("watch requests = %v, want %v", watches, want)
+	}
+}
+
+func TestAddWatchSessionLoss(t *testing.T) {
+	server := newFakeServer(t, map[string]string{
+		"/transactions":   "",
+		"/transactions/1": "INIT",
+		"/transactions/2": "INIT",
+	})
+	c := newTestClient(t, server, "")
+
+	sub, err := c.AddWatch("/transactions", AddWatchModePersistentRecursive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// the changes happen while no session is alive, no notification is sent
+	server.setDown(true)
+	server.dropSessions()
+	server.set("/transactions/1", "COMMIT")
+	server.delete("/transactions/2")
+	server.set("/transactions/3", "INIT")
+	// the first reconnect fails, the next one finds the server back
+	time.Sleep(100 * time.Millisecond)
+	server.setDown(false)
+
+	got := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		event := nextEvent(t, sub)
+		got[event.Path] = string(event.Type) + " " + string(event.Data)
+	}
+
+	want := map[string]string{
+		"/transactions/1": "NODE_UPDATED COMMIT",
+		"/transactions/2": "NODE_REMOVED INIT",
+		"/transactions/3": "NODE_ADDED INIT",
+	}
+	for path, event := range want {
+		if got[path] != event {
+			t.Errorf("event of %s = %q, want %q", path, got[path], event)
+		}
+	}
+
+	// the watch is registered on the new session
+	server.set("/transactions/3", "READY")
+	expectEvent(t, sub, NodeUpdated, "/transactions/3", "READY")
+
+	if count := server.sessionCount(); count != 1 {
+		t.Errorf("sessions = %d, want 1", count)
+	}
+}
+
+func TestAddWatchChroot(t *testing.T) {
+	server := newFakeServer(t, map[string]string{
+		"/app":           "",
+		"/app/tx":        "",
+		"/app/tx/1":      "INIT",
+		"/application":   "",
+		"/application/x": "",
+	})
+	c := newTestClient(t, server, "/app")
+
+	sub, err := c.AddWatch("/tx", AddWatchModePersistent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if data, ok := sub.Get("/tx"); !ok || string(data) != "" {
+		t.Errorf("Get(/tx) = %q, %v, want the root", data, ok)
+	}
+	if children, _ := sub.Children("/tx"); strings.Join(children, ",") != "1" {
+		t.Errorf("Children(/tx) = %v, want [1]", children)
+	}
+
+	// a persistent watch is told that the children changed
+	server.set("/app/tx/2", "INIT")
+	expectEvent(t, sub, NodeAdded, "/tx/2", "INIT")
+	server.delete("/app/tx/1")
+	expectEvent(t, sub, NodeRemoved, "/tx/1", "INIT")
+
+	if requests := server.requestLog(); requests[0] != "addWatch /app/tx 0" {
+		t.Errorf("requests = %v, want the watch inside the chroot", requests)
+	}
+
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{path: "/app", want: "/", ok: true},
+		{path: "/app/tx/1", want: "/tx/1", ok: true},
+		{path: "/application/x", ok: false},
+		{path: "/other", ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := c.relativePath(tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("relativePath(%s) = %s, %v, want %s, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package zkclient
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// watchReconnectDelay is how long a failed reconnect waits before the next
+const watchReconnectDelay = time.Second
+
+type watchKey struct {
+	path string
+	mode AddWatchMode
+}
+
+// watchSession shares one watch connection between all the subscriptions
+// of a client. Each notification is routed to the subscriptions whose
+// watch covers its path, and a watch is removed from the server once its
+// last subscription is closed. When the connection is lost a new session
+// is opened, the watches are added again and every subscription reloads
+// its subtree, so the changes made in between are delivered as events.
+type watchSession struct {
+	client *ZooKeeperClient
+
+	// mu guards the connection and the watches, it is held during the
+	// requests which register and remove the watches
+	mu      sync.Mutex
+	conn    *watchConn
+	watches map[watchKey]int
+	closed  bool
+
+	// subMu is taken by the reader of the connection to route the
+	// notifications, never while waiting for a reply
+	subMu         sync.RWMutex
+	subscriptions map[*Subscription]bool
+}
+
+// watchSession returns the watch session of the client, it connects with
+// the first subscription
+func (c *ZooKeeperClient) watchSession() *watchSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watches == nil {
+		c.watches = &watchSession{
+			client:        c,
+			watches:       make(map[watchKey]int),
+			subscriptions: make(map[*Subscription]bool),
+		}
+	}
+
+	return c.watches
+}
+
+// add routes the notifications of the watch to s and registers the watch,
+// a watch shared with another subscription is only added once
+func (ws *watchSession) add(s *Subscription) error {
+	ws.subMu.Lock()
+	ws.subscriptions[s] = true
+	ws.subMu.Unlock()
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	err := ws.addWatch(watchKey{path: s.root, mode: s.mode})
+	if err != nil {
+		ws.subMu.Lock()
+		delete(ws.subscriptions, s)
+		ws.subMu.Unlock()
+	}
+
+	return err
+}
+
+func (ws *watchSession) addWatch(key watchKey) error {
+	if ws.closed {
+		return errWatchConnClosed
+	}
+
+	if ws.conn == nil {
+		conn, err := dialWatchConn(ws.client.config, ws.route)
+		if err != nil {
+			return err
+		}
+		ws.conn = conn
+		go ws.monitor(conn)
+	}
+
+	if ws.watches[key] == 0 {
+		if err := ws.conn.AddWatch(ws.client.path(key.path), key.mode); err != nil {
+			return err
+		}
+	}
+	ws.watches[key]++
+
+	return nil
+}
+
+// remove stops the routing to s, and removes its watch from the server
+// when no other subscription uses it. The session is closed with its last
+// watch.
+func (ws *watchSession) remove(s *Subscription) {
+	ws.subMu.Lock()
+	if !ws.subscriptions[s] {
+		ws.subMu.Unlock()
+		return
+	}
+	delete(ws.subscriptions, s)
+	ws.subMu.Unlock()
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	key := watchKey{path: s.root, mode: s.mode}
+	ws.watches[key]--
+	if ws.watches[key] > 0 {
+		return
+	}
+	delete(ws.watches, key)
+
+	if ws.conn == nil {
+		return
+	}
+	if len(ws.watches) == 0 {
+		ws.conn.Close()
+		ws.conn = nil
+		return
+	}
+	if err := ws.conn.RemoveWatch(ws.client.path(key.path), key.mode); err != nil {
+		log.Printf("error in remove watch %s: %v\n", key.path, err)
+	}
+}
+
+// current returns the connection the subscriptions read from
+func (ws *watchSession) current() (*watchConn, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.conn == nil {
+		return nil, errWatchConnClosed
+	}
+
+	return ws.conn, nil
+}
+
+func (ws *watchSession) get(path string) ([]byte, error) {
+	conn, err := ws.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.Get(ws.client.path(path))
+}
+
+func (ws *watchSession) children(path string) ([]string, error) {
+	conn, err := ws.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.Children(ws.client.path(path))
+}
+
+// route is called by the reader of the connection, it never blocks
+func (ws *watchSession) route(eventType zk.EventType, serverPath string) {
+	path, ok := ws.client.relativePath(serverPath)
+	if !ok {
+		return
+	}
+
+	ws.subMu.RLock()
+	defer ws.subMu.RUnlock()
+
+	for s := range ws.subscriptions {
+		if s.covers(path) {
+			s.enqueue(eventType, path)
+		}
+	}
+}
+
+// monitor replaces the connection once it is lost, unless it was closed
+// on purpose
+func (ws *watchSession) monitor(conn *watchConn) {
+	<-conn.Closed()
+
+	ws.mu.Lock()
+	lost := ws.conn == conn && !ws.closed
+	if lost {
+		ws.conn = nil
+	}
+	ws.mu.Unlock()
+
+	if lost {
+		log.Println("watch session lost, reconnect")
+		ws.reconnect()
+	}
+}
+
+// reconnect opens a new session, adds every watch again and tells the
+// subscriptions to reload their subtree
+func (ws *watchSession) reconnect() {
+	for {
+		ws.mu.Lock()
+		if ws.closed || len(ws.watches) == 0 {
+			ws.mu.Unlock()
+			return
+		}
+
+		conn, err := dialWatchConn(ws.client.config, ws.route)
+		if err == nil {
+			for key := range ws.watches {
+				if err = conn.AddWatch(ws.client.path(key.path), key.mode); err != nil {
+					conn.Close()
+					break
+				}
+			}
+		}
+		if err != nil {
+			ws.mu.Unlock()
+			log.Printf("error in reconnect watch session: %v\n", err)
+			time.Sleep(watchReconnectDelay)
+			continue
+		}
+
+		ws.conn = conn
+		go ws.monitor(conn)
+		ws.mu.Unlock()
+
+		ws.subMu.RLock()
+		for s := range ws.subscriptions {
+			s.markStale()
+		}
+		ws.subMu.RUnlock()
+
+		return
+	}
+}
+
+// close ends the session with the client, the subscriptions stop receiving
+// events
+func (ws *watchSession) close() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.closed = true
+	if ws.conn != nil {
+		ws.conn.Close()
+		ws.conn = nil
+	}
+}
+
+// relativePath maps a server path back into the chroot namespace, a path
+// outside of the chroot is not ours
+func (c *ZooKeeperClient) relativePath(path string) (string, bool) {
+	if c.config.Chroot == "" {
+		return path, true
+	}
+	if path == c.config.Chroot {
+		return "/", true
+	}
+	if !strings.HasPrefix(path, c.config.Chroot+"/") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(path, c.config.Chroot), true
+}
@@ -1,2 +1,2 @@
 curl -X POST http://127.0.0.1:8000/v1/order -H "Content-Type: application/json" \
-     -d '{"user_id": "04937668-e73f-4035-a7d7-8f8db1a679e8", "price": 10001}'
\ No newline at end of file
+     -d '{"user_id": "04937668-e73f-4035-a7d7-8f8db1a679e8", "price": {"amount": 10001, "currency": "USD"}}'
\ No newline at end of file
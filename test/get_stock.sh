@@ -0,0 +1 @@
+curl http://127.0.0.1:8000/v1/inventory/apple
\ No newline at end of file
@@ -0,0 +1 @@
+docker compose exec -T user user seed < users.jsonl
\ No newline at end of file
@@ -6,19 +6,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"syscall"
 	"time"
 
 	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/zkclient"
 	_ "github.com/lib/pq"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type grpcHandler struct {
 	pb.UnimplementedUserServiceServer
 
-	db *sql.DB
+	serviceName string
+	db          *sql.DB
 }
 
 type transactionHandler struct {
@@ -28,11 +33,32 @@ type transactionHandler struct {
 	watcher     transaction.TransactionWatcher
 }
 
-func NewHandler(server *grpc.Server, watcher transaction.TransactionWatcher, zkClient *zkclient.ZooKeeperClient) {
+func NewHandler(server *grpc.Server, serviceName string, watcher transaction.TransactionWatcher, zkClient *zkclient.ZooKeeperClient) {
 	log.Println("create user handler")
 
-	log.Println("connect db")
-	db, err := sql.Open("postgres", "host=user-db port=5432 user=postgres password=sample_password dbname=user sslmode=disable")
+	db := openDB()
+
+	if err := seedData(db, serviceName); err != nil {
+		log.Printf("insert user failed: %v\n", err)
+	}
+
+	log.Println("register grpc handler")
+	handler := &grpcHandler{serviceName: serviceName, db: db}
+	pb.RegisterUserServiceServer(server, handler)
+
+	registerTransactionHandlers(serviceName, db, watcher, zkClient)
+}
+
+// openDB connects to the user database of DB_HOST and creates the tables,
+// every user shard has a database of its own
+func openDB() *sql.DB {
+	dbHost, ok := syscall.Getenv("DB_HOST")
+	if !ok {
+		dbHost = "user-db"
+	}
+
+	log.Printf("connect db %s\n", dbHost)
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=5432 user=postgres password=sample_password dbname=user sslmode=disable", dbHost))
 	if err != nil {
 		log.Fatalf("connect db error: %v", err)
 	}
@@ -45,141 +71,203 @@ func NewHandler(server *grpc.Server, watcher transaction.TransactionWatcher, zkC
 		log.Fatalf("ping db error: %v", err)
 	}
 
+	// the balances are in minor units of the wallet currency, the wallets
+	// created before the currency hold USD
 	log.Println("create table")
 	query := `
 		CREATE TABLE IF NOT EXISTS "users" (
 			id VARCHAR(1024) PRIMARY KEY,
-			balance INT
+			balance BIGINT
+		);
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS name VARCHAR(1024) NOT NULL DEFAULT '';
+		ALTER TABLE users ALTER COLUMN balance TYPE BIGINT;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+		CREATE TABLE IF NOT EXISTS "ledger_entries" (
+			id BIGSERIAL PRIMARY KEY,
+			user_id VARCHAR(1024) REFERENCES users (id),
+			transaction_id VARCHAR(1024),
+			transaction_type VARCHAR(64),
+			direction VARCHAR(8),
+			amount BIGINT,
+			balance BIGINT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		ALTER TABLE ledger_entries ALTER COLUMN amount TYPE BIGINT, ALTER COLUMN balance TYPE BIGINT;
+		ALTER TABLE ledger_entries ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+		CREATE INDEX IF NOT EXISTS ledger_entries_user_id ON ledger_entries (user_id, id);
+		CREATE INDEX IF NOT EXISTS ledger_entries_transaction_id ON ledger_entries (transaction_id);
+		CREATE TABLE IF NOT EXISTS "balance_holds" (
+			transaction_id VARCHAR(1024),
+			transaction_type VARCHAR(64),
+			user_id VARCHAR(1024) REFERENCES users (id),
+			direction VARCHAR(8),
+			amount BIGINT,
+			currency CHAR(3) NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (transaction_type, transaction_id, user_id)
 		);
+		ALTER TABLE balance_holds DROP CONSTRAINT IF EXISTS balance_holds_pkey;
+		ALTER TABLE balance_holds ADD CONSTRAINT balance_holds_pkey PRIMARY KEY (transaction_type, transaction_id, user_id);
+		CREATE INDEX IF NOT EXISTS balance_holds_user_id ON balance_holds (user_id);
 	`
 	_, err = db.Exec(query)
 	if err != nil {
 		log.Printf("table created failed: %v\n", err)
 	}
 
-	if err = seedData(db); err != nil {
-		log.Printf("insert user failed: %v\n", err)
-	}
-
-	log.Println("register grpc handler")
-	handler := &grpcHandler{db: db}
-	pb.RegisterUserServiceServer(server, handler)
-
-	registerTransactionHandlers(db, watcher, zkClient)
+	return db
 }
 
-func seedData(db *sql.DB) error {
+// seedData creates the demo user once, on the shard which owns it
+func seedData(db *sql.DB, serviceName string) error {
+	user := User{Id: "04937668-e73f-4035-a7d7-8f8db1a679e8", Name: "demo", Balance: 10000, Currency: money.DefaultCurrency}
+	if transaction.ShardFor("user", user.Id) != serviceName {
+		return nil
+	}
+
 	log.Println("seed user")
-	id := "04937668-e73f-4035-a7d7-8f8db1a679e8"
 
-	var user User
+	if _, err := insertUser(db, user); err != nil {
+		return fmt.Errorf("insert user failed: %v", err)
+	}
 
-	row := db.QueryRow("SELECT id FROM users WHERE id = $1", id)
+	return nil
+}
 
-	if err := row.Scan(&user.Id); err != nil {
-		if err == sql.ErrNoRows {
-			log.Println("user not found")
-		} else {
-			return err
-		}
+// insertUser returns false when the user already exists, the balance is
+// recorded as the opening entry of the ledger
+func insertUser(db *sql.DB, user User) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
 	}
+	defer tx.Rollback()
 
-	_, err := db.Exec("INSERT INTO users (id, balance) VALUES ($1, $2)", id, 10000)
+	query := "INSERT INTO users (id, name, balance, currency) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO NOTHING"
+	result, err := tx.Exec(query, user.Id, user.Name, user.Balance, user.Currency)
 	if err != nil {
-		return fmt.Errorf("insert user failed: %v", err)
+		return false, err
 	}
 
-	return nil
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		return false, err
+	}
+
+	query = `
+		INSERT INTO ledger_entries (user_id, transaction_id, transaction_type, direction, amount, balance, currency)
+		VALUES ($1, '', $2, $3, $4, $4, $5)
+	`
+	if _, err := tx.Exec(query, user.Id, openingBalance, Credit, user.Balance, user.Currency); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
 }
 
-func registerTransactionHandlers(db *sql.DB, watcher transaction.TransactionWatcher, client *zkclient.ZooKeeperClient) {
+func registerTransactionHandlers(serviceName string, db *sql.DB, watcher transaction.TransactionWatcher, client *zkclient.ZooKeeperClient) {
 	log.Println("register transaction handler")
 	txHandler := &transactionHandler{
-		serviceName: "user",
+		serviceName: serviceName,
 		db:          db,
 		client:      client,
 		watcher:     watcher,
 	}
 
 	watcher.RegisterHandler(transaction.OrderCreation, txHandler.prepareDeductBalance, txHandler.finalizeDeductBalance)
+	watcher.RegisterHandler(transaction.OrderCancellation, txHandler.prepareRefundBalance, txHandler.finalizeRefundBalance)
+	watcher.RegisterHandler(transaction.WalletTopUp, txHandler.prepareTopUp, txHandler.finalizeTopUp)
+	watcher.RegisterHandler(transaction.WalletTransfer, txHandler.prepareTransfer, txHandler.finalizeTransfer)
 
 	watcher.Watch()
+
+	go txHandler.reapHolds()
 }
 
 func (h *transactionHandler) prepareDeductBalance(txData transaction.TransactionData) error {
 	log.Println("user service: 2pc deduct wallet")
 
-	// Ensure the transaction is prepared
-	path := h.watcher.GetBasePath() + "/" + string(transaction.OrderCreation) + "/" + txData.Id + "/" + h.serviceName
-	for {
-		data, ch, err := h.client.GetW(path)
-		if err != nil {
-			return fmt.Errorf("error in set %s watches: %v", path, err)
-		}
-		log.Printf("prepare deduct balance status: %s\n", data)
+	var data *pb.PlaceOrderRequest
+	return h.prepareWith(txData, &data, func(tx *sql.Tx) (*transaction.AbortReason, error) {
+		return hold(tx, txData, data.UserId, Debit, data.Price)
+	})
+}
 
-		if string(data) == string(transaction.StatusPrepared) {
-			break
-		}
+// prepareRefundBalance credits the price of a cancelled order back, the
+// order participant checks the order belongs to the user
+func (h *transactionHandler) prepareRefundBalance(txData transaction.TransactionData) error {
+	log.Println("user service: 2pc refund wallet")
 
-		if string(data) != string(transaction.StatusInit) {
-			return nil
-		}
+	var data *pb.OrderRefund
+	return h.prepareWith(txData, &data, func(tx *sql.Tx) (*transaction.AbortReason, error) {
+		return hold(tx, txData, data.UserId, Credit, data.Amount)
+	})
+}
 
-		<-ch
+// prepareWith decodes the payload into data and runs apply in a local
+// transaction. apply records holds, which are committed before the vote so
+// no row stays locked until the decision, or returns a reason to vote abort.
+func (h *transactionHandler) prepareWith(txData transaction.TransactionData, data any, apply func(tx *sql.Tx) (*transaction.AbortReason, error)) error {
+	path := h.watcher.GetBasePath() + "/" + string(txData.Type) + "/" + txData.Id + "/" + h.serviceName
+	prepared, err := h.watcher.EnterPrepare(txData, h.serviceName)
+	if err != nil {
+		return err
+	}
+	if !prepared {
+		log.Printf("skip %s transaction %s\n", txData.Type, txData.Id)
+		return nil
 	}
+	defer h.watcher.LeavePrepare(txData, h.serviceName)
 
 	tx, err := h.db.Begin()
 	if err != nil {
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
+		h.rollback(tx, txData, internalReason(err))
 		return fmt.Errorf("error in start transaction: %v", err)
 	}
-	defer tx.Commit()
+	defer tx.Rollback()
 
-	var data *pb.PlaceOrderRequest
-	var user User
-
-	if err := json.Unmarshal(txData.Payload, &data); err != nil {
+	if err := json.Unmarshal(txData.Payload, data); err != nil {
+		h.rollback(tx, txData, internalReason(err))
 		return fmt.Errorf("error in unmarshal payload: %v", err)
 	}
 
-	query := "SELECT id, balance FROM users WHERE id = $1 FOR UPDATE"
-	row := tx.QueryRow(query, data.UserId)
-	if err := row.Scan(&user.Id, &user.Balance); err != nil {
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("user id %s not found", data.UserId)
-		}
+	reason, err := apply(tx)
+	if err != nil {
+		h.rollback(tx, txData, internalReason(err))
 		return err
 	}
-
-	if user.Balance < int(data.Price) {
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
-		return fmt.Errorf("error insufficient wallet balance")
-	}
-
-	query = `
-		UPDATE users
-		SET balance = balance - $1
-		WHERE id = $2
-	`
-	if _, err := tx.Exec(query, data.Price, data.UserId); err != nil {
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
-		return err
+	if reason != nil {
+		h.rollback(tx, txData, *reason)
+		return fmt.Errorf("error in prepare %s transaction %s: %s", txData.Type, txData.Id, reason.Message)
 	}
 
-	query = fmt.Sprintf("PREPARE TRANSACTION '%s'", txData.Id)
-	_, err = tx.Exec(query)
-	if err != nil {
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
-		return fmt.Errorf("error in execute prepare statement: %v", err)
+	if err := tx.Commit(); err != nil {
+		h.rollback(nil, txData, internalReason(err))
+		return fmt.Errorf("error in commit holds: %v", err)
 	}
 
 	log.Println("write znode value")
 	err = h.client.Set(path, []byte(transaction.StatusReady))
 	if err != nil {
 		log.Printf("error in write in zookeeper: %v\n", err)
-		h.rollback(tx, txData.Id, transaction.OrderCreation)
+
+		// the write may have reached ZooKeeper before the connection was
+		// lost, the holds are only released when the vote was not recorded
+		status, getErr := h.client.Get(path)
+		if getErr != nil {
+			log.Printf("error in read vote of transaction %s, its holds are kept: %v\n", txData.Id, getErr)
+			return fmt.Errorf("error in write in zookeeper: %v", err)
+		}
+		switch transaction.TransactionStatus(status) {
+		case transaction.StatusReady, transaction.StatusCommit, transaction.StatusCommitted:
+			log.Println("user service ready")
+			return nil
+		}
+
+		if err := h.releaseHolds(txData.Type, txData.Id); err != nil {
+			log.Println(err)
+		}
+		h.rollback(nil, txData, internalReason(err))
 		return fmt.Errorf("error in write in zookeeper: %v", err)
 	}
 
@@ -189,7 +277,21 @@ func (h *transactionHandler) prepareDeductBalance(txData transaction.Transaction
 }
 
 func (h *transactionHandler) finalizeDeductBalance(txId string) error {
-	path := h.watcher.GetBasePath() + "/" + string(transaction.OrderCreation) + "/" + txId + "/" + h.serviceName
+	return h.finalize(transaction.OrderCreation, txId)
+}
+
+func (h *transactionHandler) finalizeRefundBalance(txId string) error {
+	return h.finalize(transaction.OrderCancellation, txId)
+}
+
+// finalize applies the holds of a committed transaction, or releases the
+// holds of a rolled back one
+func (h *transactionHandler) finalize(txType transaction.TransactionType, txId string) error {
+	if err := h.watcher.WaitDecision(txId); err != nil {
+		return err
+	}
+
+	path := h.watcher.GetBasePath() + "/" + string(txType) + "/" + txId + "/" + h.serviceName
 	for {
 		data, ch, err := h.client.GetW(path) // watches transaction znode value
 		if err != nil {
@@ -199,14 +301,9 @@ func (h *transactionHandler) finalizeDeductBalance(txId string) error {
 		switch string(data) {
 		case string(transaction.StatusCommit):
 			for {
-				log.Println("Commit deduct balance transaction")
-				query := fmt.Sprintf("COMMIT PREPARED '%s'", txId)
-				_, err := h.db.Exec(query)
-				if err != nil {
-					if err == sql.ErrTxDone {
-						break
-					}
-					log.Printf("error in commit prepared transaction %s: %v\n", txId, err)
+				log.Printf("Commit %s transaction %s\n", txType, txId)
+				if err := h.applyHolds(txType, txId); err != nil {
+					log.Println(err)
 					time.Sleep(time.Second)
 					continue
 				}
@@ -224,21 +321,16 @@ func (h *transactionHandler) finalizeDeductBalance(txId string) error {
 			return nil
 		case string(transaction.StatusRollBack):
 			for {
-				log.Println("Rollback deduct balance transaction")
-				query := fmt.Sprintf("ROLLBACK PREPARED '%s'", txId)
-				_, err := h.db.Exec(query)
-				if err != nil {
-					if err == sql.ErrTxDone {
-						break
-					}
-					log.Printf("error in rollback prepared transaction %s: %v\n", txId, err)
+				log.Printf("Rollback %s transaction %s\n", txType, txId)
+				if err := h.releaseHolds(txType, txId); err != nil {
+					log.Println(err)
 					time.Sleep(time.Second)
 					continue
 				}
 				break
 			}
 			for {
-				err = h.client.Set(path, []byte(transaction.StatusCommitted))
+				err = h.client.Set(path, []byte(transaction.StatusRolledBack))
 				if err != nil {
 					log.Printf("error in set znode value: %v\n", err)
 					time.Sleep(time.Second)
@@ -250,24 +342,36 @@ func (h *transactionHandler) finalizeDeductBalance(txId string) error {
 		case string(transaction.StatusCommitted):
 			return nil
 		case string(transaction.StatusRolledBack):
+			// written by the coordinator when this participant did not vote,
+			// the holds may have been committed before the vote was lost
+			for {
+				if err := h.releaseHolds(txType, txId); err != nil {
+					log.Println(err)
+					time.Sleep(time.Second)
+					continue
+				}
+				break
+			}
 			return nil
 		default:
-			log.Printf("finalize deduct balance transaction data: %v\n", string(data))
+			log.Printf("finalize %s transaction data: %v\n", txType, string(data))
 		}
 
 		<-ch
 	}
 }
 
-func (h *transactionHandler) rollback(tx *sql.Tx, txId string, txType transaction.TransactionType) error {
-	path := h.watcher.GetBasePath() + "/" + string(txType) + "/" + txId + "/" + h.serviceName
-	tx.Rollback()
-	err := h.client.Set(path, []byte(transaction.StatusAbort))
-	if err != nil {
-		return err
+// rollback votes abort with the reason shown to the client
+func (h *transactionHandler) rollback(tx *sql.Tx, txData transaction.TransactionData, reason transaction.AbortReason) error {
+	if tx != nil {
+		tx.Rollback()
 	}
 
-	return nil
+	return h.watcher.VoteAbort(txData, h.serviceName, reason)
+}
+
+func internalReason(err error) transaction.AbortReason {
+	return transaction.AbortReason{Code: transaction.ReasonInternal, Message: err.Error()}
 }
 
 func (h *grpcHandler) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
@@ -276,13 +380,13 @@ func (h *grpcHandler) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.
 	var resp pb.GetUserResponse
 
 	query := `
-		SELECT id, balance FROM users
+		SELECT ` + userColumns + ` FROM users
 		WHERE id = $1
 	`
 	row := h.db.QueryRow(query, req.UserId)
-	if err := row.Scan(&resp.Id, &resp.Balance); err != nil {
+	if err := scanUser(row, &resp); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user id %s not found", req.UserId)
+			return nil, status.Errorf(codes.NotFound, "user id %s not found", req.UserId)
 		}
 		return nil, fmt.Errorf("user id %s: %v", req.UserId, err)
 	}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+	"github.com/go-zookeeper/zk"
+)
+
+// hold records the balance change of a transaction until it is decided. A
+// debit hold reserves the amount, the available balance is the balance
+// without the debit holds, and a credit hold is not available before the
+// commit. The user row is locked only while the hold is checked, not until
+// the transaction is decided.
+func hold(tx *sql.Tx, txData transaction.TransactionData, userId string, direction Direction, amount *pb.Money) (*transaction.AbortReason, error) {
+	if err := money.Validate(amount); err != nil {
+		return nil, fmt.Errorf("error in hold user %s balance: %v", userId, err)
+	}
+
+	balance := &pb.Money{}
+	row := tx.QueryRow("SELECT balance, currency FROM users WHERE id = $1 FOR UPDATE", userId)
+	if err := row.Scan(&balance.Amount, &balance.Currency); err != nil {
+		if err == sql.ErrNoRows {
+			return &transaction.AbortReason{
+				Code:    transaction.ReasonUserNotFound,
+				Message: fmt.Sprintf("user id %s not found", userId),
+			}, nil
+		}
+		return nil, fmt.Errorf("error in get user %s balance: %v", userId, err)
+	}
+
+	if balance.Currency != amount.Currency {
+		return &transaction.AbortReason{
+			Code:    transaction.ReasonCurrencyMismatch,
+			Message: fmt.Sprintf("wallet of user %s holds %s, not %s", userId, balance.Currency, amount.Currency),
+		}, nil
+	}
+
+	var debits, credits int64
+	query := `
+		SELECT
+			COALESCE(SUM(amount) FILTER (WHERE direction = $2), 0),
+			COALESCE(SUM(amount) FILTER (WHERE direction = $3), 0)
+		FROM balance_holds
+		WHERE user_id = $1
+	`
+	if err := tx.QueryRow(query, userId, Debit, Credit).Scan(&debits, &credits); err != nil {
+		return nil, fmt.Errorf("error in get user %s holds: %v", userId, err)
+	}
+
+	if direction == Debit {
+		available := money.New(balance.Amount-debits, balance.Currency)
+		if available.Amount < amount.Amount {
+			return &transaction.AbortReason{
+				Code:    transaction.ReasonInsufficientFunds,
+				Message: fmt.Sprintf("insufficient wallet balance, %s is available", money.String(available)),
+			}, nil
+		}
+	} else {
+		// the balance must hold every pending credit once they commit
+		pending, err := money.Add(balance, money.New(credits, balance.Currency))
+		if err == nil {
+			_, err = money.Add(pending, amount)
+		}
+		if err != nil {
+			return &transaction.AbortReason{Code: transaction.ReasonAmountOverflow, Message: err.Error()}, nil
+		}
+	}
+
+	query = `
+		INSERT INTO balance_holds (transaction_id, transaction_type, user_id, direction, amount, currency)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	if _, err := tx.Exec(query, txData.Id, txData.Type, userId, direction, amount.Amount, amount.Currency); err != nil {
+		return nil, fmt.Errorf("error in insert user %s hold: %v", userId, err)
+	}
+
+	return nil, nil
+}
+
+type balanceHold struct {
+	userId    string
+	direction Direction
+	amount    *pb.Money
+}
+
+// applyHolds turns the holds of a committed transaction into balance
+// changes, the users are locked in the id order like the wallets of a
+// transfer. The holds are deleted in the same local transaction, so they
+// are applied once.
+func (h *transactionHandler) applyHolds(txType transaction.TransactionType, txId string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error in start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := "DELETE FROM balance_holds WHERE transaction_id = $1 AND transaction_type = $2 RETURNING user_id, direction, amount, currency"
+	rows, err := tx.Query(query, txId, txType)
+	if err != nil {
+		return fmt.Errorf("error in delete transaction %s holds: %v", txId, err)
+	}
+
+	var holds []balanceHold
+	for rows.Next() {
+		held := balanceHold{amount: &pb.Money{}}
+		if err := rows.Scan(&held.userId, &held.direction, &held.amount.Amount, &held.amount.Currency); err != nil {
+			rows.Close()
+			return fmt.Errorf("error in scan transaction %s hold: %v", txId, err)
+		}
+		holds = append(holds, held)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error in delete transaction %s holds: %v", txId, err)
+	}
+
+	sort.Slice(holds, func(i, j int) bool { return holds[i].userId < holds[j].userId })
+
+	txData := transaction.TransactionData{Id: txId, Type: txType}
+	for _, held := range holds {
+		reason, err := changeBalance(tx, txData, held.userId, held.direction, held.amount)
+		if err != nil {
+			return err
+		}
+		if reason != nil {
+			return fmt.Errorf("error in apply transaction %s hold of user %s: %s", txId, held.userId, reason.Message)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error in commit transaction %s holds: %v", txId, err)
+	}
+
+	return nil
+}
+
+// releaseHolds drops the holds of a rolled back transaction
+func (h *transactionHandler) releaseHolds(txType transaction.TransactionType, txId string) error {
+	if _, err := h.db.Exec("DELETE FROM balance_holds WHERE transaction_id = $1 AND transaction_type = $2", txId, txType); err != nil {
+		return fmt.Errorf("error in release transaction %s holds: %v", txId, err)
+	}
+
+	return nil
+}
+
+// holdReapInterval is how often the holds left behind are looked for
+const holdReapInterval = time.Minute
+
+// reapHolds settles the holds whose transaction is decided or gone, e.g.
+// when the service stopped between the hold and its vote, or the
+// transaction completed without this participant. A hold is applied once
+// its participant has to commit, and released once it has to roll back or
+// the transaction no longer exists.
+func (h *transactionHandler) reapHolds() {
+	ticker := time.NewTicker(holdReapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.reapHoldsOnce(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (h *transactionHandler) reapHoldsOnce() error {
+	rows, err := h.db.Query("SELECT DISTINCT transaction_id, transaction_type FROM balance_holds")
+	if err != nil {
+		return fmt.Errorf("error in list holds: %v", err)
+	}
+
+	type heldTransaction struct {
+		id     string
+		txType transaction.TransactionType
+	}
+	var held []heldTransaction
+	for rows.Next() {
+		var tx heldTransaction
+		if err := rows.Scan(&tx.id, &tx.txType); err != nil {
+			rows.Close()
+			return fmt.Errorf("error in scan hold: %v", err)
+		}
+		held = append(held, tx)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error in list holds: %v", err)
+	}
+
+	for _, tx := range held {
+		path := h.watcher.GetBasePath() + "/" + string(tx.txType) + "/" + tx.id + "/" + h.serviceName
+		data, err := h.client.Get(path)
+		if err != nil && err != zk.ErrNoNode {
+			log.Printf("error in get znode %s: %v\n", path, err)
+			continue
+		}
+
+		switch {
+		case err == zk.ErrNoNode, string(data) == string(transaction.StatusRollBack), string(data) == string(transaction.StatusRolledBack):
+			log.Printf("release holds of %s transaction %s\n", tx.txType, tx.id)
+			err = h.releaseHolds(tx.txType, tx.id)
+		case string(data) == string(transaction.StatusCommit):
+			log.Printf("apply holds of %s transaction %s\n", tx.txType, tx.id)
+			err = h.applyHolds(tx.txType, tx.id)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+type Direction string
+
+const (
+	Debit  Direction = "DEBIT"
+	Credit Direction = "CREDIT"
+)
+
+// the balance a user is created with is recorded without a transaction
+const openingBalance = "OPENING_BALANCE"
+
+// changeBalance moves the balance of the user and records the ledger entry
+// in the same local transaction, the committed holds are applied with it.
+// It returns a reason when the user is missing, the wallet holds another
+// currency, a debit exceeds the balance or a credit overflows it.
+func changeBalance(tx *sql.Tx, txData transaction.TransactionData, userId string, direction Direction, amount *pb.Money) (*transaction.AbortReason, error) {
+	if err := money.Validate(amount); err != nil {
+		return nil, fmt.Errorf("error in change user %s balance: %v", userId, err)
+	}
+
+	balance := &pb.Money{}
+	row := tx.QueryRow("SELECT balance, currency FROM users WHERE id = $1 FOR UPDATE", userId)
+	if err := row.Scan(&balance.Amount, &balance.Currency); err != nil {
+		if err == sql.ErrNoRows {
+			return &transaction.AbortReason{
+				Code:    transaction.ReasonUserNotFound,
+				Message: fmt.Sprintf("user id %s not found", userId),
+			}, nil
+		}
+		return nil, fmt.Errorf("error in get user %s balance: %v", userId, err)
+	}
+
+	if balance.Currency != amount.Currency {
+		return &transaction.AbortReason{
+			Code:    transaction.ReasonCurrencyMismatch,
+			Message: fmt.Sprintf("wallet of user %s holds %s, not %s", userId, balance.Currency, amount.Currency),
+		}, nil
+	}
+
+	var err error
+	if direction == Debit {
+		if balance.Amount < amount.Amount {
+			return &transaction.AbortReason{
+				Code:    transaction.ReasonInsufficientFunds,
+				Message: fmt.Sprintf("insufficient wallet balance, %s is available", money.String(balance)),
+			}, nil
+		}
+		balance.Amount -= amount.Amount
+	} else if balance, err = money.Add(balance, amount); err != nil {
+		return &transaction.AbortReason{Code: transaction.ReasonAmountOverflow, Message: err.Error()}, nil
+	}
+
+	if _, err := tx.Exec("UPDATE users SET balance = $1 WHERE id = $2", balance.Amount, userId); err != nil {
+		return nil, fmt.Errorf("error in update user %s balance: %v", userId, err)
+	}
+
+	query := `
+		INSERT INTO ledger_entries (user_id, transaction_id, transaction_type, direction, amount, balance, currency)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	if _, err := tx.Exec(query, userId, txData.Id, txData.Type, direction, amount.Amount, balance.Amount, balance.Currency); err != nil {
+		return nil, fmt.Errorf("error in insert user %s ledger entry: %v", userId, err)
+	}
+
+	return nil, nil
+}
+
+func (h *grpcHandler) GetLedger(ctx context.Context, req *pb.GetLedgerRequest) (*pb.GetLedgerResponse, error) {
+	log.Println("user service: get ledger")
+
+	if req.UserId != "" {
+		if _, err := h.GetUser(ctx, &pb.GetUserRequest{UserId: req.UserId}); err != nil {
+			return nil, err
+		}
+	}
+
+	// the entry ids only grow, the next page starts before the last one
+	before := int64(-1)
+	if req.PageToken != "" {
+		id, err := strconv.ParseInt(req.PageToken, 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token: %v", err)
+		}
+		before = id
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	pageSize = min(pageSize, maxPageSize)
+
+	query := `
+		SELECT id, user_id, transaction_id, transaction_type, direction, amount, balance, currency, created_at
+		FROM ledger_entries
+		WHERE ($1 = '' OR user_id = $1)
+			AND ($2 = '' OR transaction_type = $2)
+			AND ($3::BIGINT < 0 OR id < $3::BIGINT)
+			AND ($5 = '' OR transaction_id = $5)
+		ORDER BY id DESC
+		LIMIT $4
+	`
+	rows, err := h.db.QueryContext(ctx, query, req.UserId, req.TransactionType, before, pageSize+1, req.TransactionId)
+	if err != nil {
+		return nil, fmt.Errorf("error in query ledger entries: %v", err)
+	}
+	defer rows.Close()
+
+	resp := &pb.GetLedgerResponse{}
+	for rows.Next() {
+		var entry pb.LedgerEntry
+		var amount, balance int64
+		var currency string
+		var createdAt time.Time
+		err := rows.Scan(&entry.Id, &entry.UserId, &entry.TransactionId, &entry.TransactionType,
+			&entry.Direction, &amount, &balance, &currency, &createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("error in scan ledger entry: %v", err)
+		}
+		entry.Amount, entry.Balance = money.New(amount, currency), money.New(balance, currency)
+		entry.CreatedAt = timestamppb.New(createdAt)
+
+		if len(resp.Entries) == pageSize {
+			resp.NextPageToken = strconv.FormatInt(resp.Entries[pageSize-1].Id, 10)
+			break
+		}
+		resp.Entries = append(resp.Entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error in query ledger entries: %v", err)
+	}
+
+	return resp, nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"slices"
 	"syscall"
 
 	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
@@ -12,39 +14,62 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		seed(os.Args[2:])
+		return
+	}
+
 	host, ok := syscall.Getenv("HOST")
 	if !ok {
 		host = "127.0.0.1"
 	}
 
+	// every user shard is a participant of its own
+	serviceName := shardName()
+
 	listen, err := net.Listen("tcp", fmt.Sprintf("%s:8080", host))
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 	defer listen.Close()
 
-	zkServer, ok := syscall.Getenv("ZK_SERVER")
-	if !ok {
-		zkServer = "localhost:2181"
+	zkConfig, err := zkclient.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	zkClient, err := zkclient.NewZooKeeperClient([]string{zkServer})
+	zkClient, err := zkclient.NewZooKeeperClient(zkConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Println("new transaction watcher")
-	txWatcher, err := transaction.NewTransactionWatcher(zkClient)
+	txWatcher, err := transaction.NewTransactionWatcher(zkClient, serviceName)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	server := grpc.NewServer()
-	NewHandler(server, txWatcher, zkClient)
+	NewHandler(server, serviceName, txWatcher, zkClient)
 
-	log.Printf("User service started at %s:8080\n", host)
+	log.Printf("User service %s started at %s:8080\n", serviceName, host)
 
 	if err := server.Serve(listen); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// shardName returns the participant name of this user service from
+// SERVICE_NAME, it must be one of the USER_SHARDS
+func shardName() string {
+	serviceName, ok := syscall.Getenv("SERVICE_NAME")
+	if !ok {
+		serviceName = "user"
+	}
+
+	if shards := transaction.LoadShards("user"); !slices.Contains(shards, serviceName) {
+		log.Fatalf("service %s is not one of the user shards %v", serviceName, shards)
+	}
+
+	return serviceName
+}
@@ -1,6 +1,9 @@
 package main
 
+// User is a wallet, the balance is in minor units of the currency
 type User struct {
-	Id      string
-	Balance int
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Balance  int64  `json:"balance"`
+	Currency string `json:"currency"`
 }
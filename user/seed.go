@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+// seed loads users from a file with one JSON user per line, the users
+// which already exist or belong to another shard are skipped and the
+// currency defaults to USD, e.g.
+//
+//	user seed -file users.jsonl
+//	docker compose exec -T user user seed < test/users.jsonl
+//	docker compose exec -T user-2 user seed < test/users.jsonl
+func seed(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	file := flags.String("file", "", "users file, stdin by default")
+	flags.Parse(args)
+
+	var reader io.Reader = os.Stdin
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		reader = f
+	}
+
+	serviceName := shardName()
+
+	db := openDB()
+	defer db.Close()
+
+	created, skipped, elsewhere := 0, 0, 0
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var user User
+		if err := json.Unmarshal(scanner.Bytes(), &user); err != nil {
+			log.Fatalf("error in unmarshal user at line %d: %v", line, err)
+		}
+		if user.Currency == "" {
+			user.Currency = money.DefaultCurrency
+		}
+		if user.Id == "" || money.Validate(money.New(user.Balance, user.Currency)) != nil {
+			log.Fatalf("invalid user at line %d: an id, a balance of at least 0 and an ISO currency are required", line)
+		}
+
+		if transaction.ShardFor("user", user.Id) != serviceName {
+			elsewhere++
+			continue
+		}
+
+		ok, err := insertUser(db, user)
+		if err != nil {
+			log.Fatalf("error in insert user %s: %v", user.Id, err)
+		}
+		if ok {
+			created++
+		} else {
+			skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("seeded %d users, %d already existed, %d belong to another shard\n", created, skipped, elsewhere)
+}
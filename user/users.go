@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/money"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+func (h *grpcHandler) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.GetUserResponse, error) {
+	log.Println("user service: create user")
+
+	balance := money.Normalize(req.Balance)
+	if err := money.Validate(balance); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid balance: %v", err)
+	}
+
+	// the id decides the shard of the user
+	user := User{Id: req.Id, Name: req.Name, Balance: balance.Amount, Currency: balance.Currency}
+	if user.Id == "" {
+		user.Id = newUserId(h.serviceName)
+	}
+	if shard := transaction.ShardFor("user", user.Id); shard != h.serviceName {
+		return nil, status.Errorf(codes.FailedPrecondition, "user id %s belongs to shard %s", user.Id, shard)
+	}
+
+	created, err := insertUser(h.db, user)
+	if err != nil {
+		return nil, fmt.Errorf("error in insert user %s: %v", user.Id, err)
+	}
+	if !created {
+		return nil, status.Errorf(codes.AlreadyExists, "user id %s already exists", user.Id)
+	}
+
+	return &pb.GetUserResponse{Id: user.Id, Name: user.Name, Balance: balance, Available: balance}, nil
+}
+
+// newUserId draws ids until one belongs to the shard
+func newUserId(serviceName string) string {
+	for {
+		id := uuid.New().String()
+		if transaction.ShardFor("user", id) == serviceName {
+			return id
+		}
+	}
+}
+
+func (h *grpcHandler) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	log.Println("user service: list users")
+
+	after, err := base64.RawURLEncoding.DecodeString(req.PageToken)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token: %v", err)
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	pageSize = min(pageSize, maxPageSize)
+
+	// one more row tells whether there is a next page
+	query := `
+		SELECT ` + userColumns + ` FROM users
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+	`
+	rows, err := h.db.QueryContext(ctx, query, string(after), pageSize+1)
+	if err != nil {
+		return nil, fmt.Errorf("error in query users: %v", err)
+	}
+	defer rows.Close()
+
+	resp := &pb.ListUsersResponse{}
+	for rows.Next() {
+		var user pb.GetUserResponse
+		if err := scanUser(rows, &user); err != nil {
+			return nil, fmt.Errorf("error in scan user: %v", err)
+		}
+
+		if len(resp.Users) == pageSize {
+			resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(resp.Users[pageSize-1].Id))
+			break
+		}
+		resp.Users = append(resp.Users, &user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error in query users: %v", err)
+	}
+
+	return resp, nil
+}
+
+// UpdateUser changes the profile of the user, the balance is left to the
+// transactions
+func (h *grpcHandler) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.GetUserResponse, error) {
+	log.Println("user service: update user")
+
+	var resp pb.GetUserResponse
+	query := `
+		UPDATE users
+		SET name = $1
+		WHERE id = $2
+		RETURNING ` + userColumns
+	row := h.db.QueryRowContext(ctx, query, req.Name, req.UserId)
+	if err := scanUser(row, &resp); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user id %s not found", req.UserId)
+		}
+		return nil, fmt.Errorf("error in update user %s: %v", req.UserId, err)
+	}
+
+	return &resp, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// userColumns reads a user with the available balance, the balance without
+// the debit holds
+const userColumns = `id, balance, currency, name,
+	balance - COALESCE((SELECT SUM(amount) FROM balance_holds WHERE user_id = users.id AND direction = 'DEBIT'), 0)`
+
+// scanUser reads the userColumns
+func scanUser(row rowScanner, user *pb.GetUserResponse) error {
+	user.Balance, user.Available = &pb.Money{}, &pb.Money{}
+	if err := row.Scan(&user.Id, &user.Balance.Amount, &user.Balance.Currency, &user.Name, &user.Available.Amount); err != nil {
+		return err
+	}
+	user.Available.Currency = user.Balance.Currency
+
+	return nil
+}
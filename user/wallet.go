@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	pb "github.com/Alvintan0712/two-phase-commit-demo/shared/api/proto"
+	"github.com/Alvintan0712/two-phase-commit-demo/shared/pkg/transaction"
+)
+
+func (h *transactionHandler) prepareTopUp(txData transaction.TransactionData) error {
+	log.Println("user service: 2pc top up wallet")
+
+	var data *pb.TopUpRequest
+	return h.prepareWith(txData, &data, func(tx *sql.Tx) (*transaction.AbortReason, error) {
+		return hold(tx, txData, data.UserId, Credit, data.Amount)
+	})
+}
+
+func (h *transactionHandler) finalizeTopUp(txId string) error {
+	return h.finalize(transaction.WalletTopUp, txId)
+}
+
+// prepareTransfer holds the sides of the transfer whose wallets this shard
+// owns, the debit of the payer and the credit of the payee. Wallets on
+// different shards are held by the participant of each shard.
+func (h *transactionHandler) prepareTransfer(txData transaction.TransactionData) error {
+	log.Println("user service: 2pc transfer between wallets")
+
+	var data *pb.TransferRequest
+	return h.prepareWith(txData, &data, func(tx *sql.Tx) (*transaction.AbortReason, error) {
+		debit := transaction.ShardFor("user", data.FromUserId) == h.serviceName
+		credit := transaction.ShardFor("user", data.ToUserId) == h.serviceName
+		if !debit && !credit {
+			return nil, fmt.Errorf("no wallet of transfer %s on shard %s", txData.Id, h.serviceName)
+		}
+
+		// lock both wallets in the id order to avoid deadlocks
+		if debit && credit {
+			query := "SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE"
+			if _, err := tx.Exec(query, data.FromUserId, data.ToUserId); err != nil {
+				return nil, fmt.Errorf("error in lock wallets: %v", err)
+			}
+		}
+
+		if debit {
+			reason, err := hold(tx, txData, data.FromUserId, Debit, data.Amount)
+			if reason != nil || err != nil {
+				return reason, err
+			}
+		}
+		if credit {
+			return hold(tx, txData, data.ToUserId, Credit, data.Amount)
+		}
+
+		return nil, nil
+	})
+}
+
+func (h *transactionHandler) finalizeTransfer(txId string) error {
+	return h.finalize(transaction.WalletTransfer, txId)
+}